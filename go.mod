@@ -2,4 +2,8 @@ module telegram-bot
 
 go 1.21
 
-require github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
+require (
+	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
+	golang.org/x/image v0.14.0
+	golang.org/x/text v0.14.0
+)
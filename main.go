@@ -1,362 +1,4502 @@
-package main
-
-import (
-	"encoding/json"
-	"fmt"
-	"log"
-	"os"
-	"os/signal"
-	"regexp"
-	"strings"
-	"sync"
-	"syscall"
-
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-)
-
-// --- Constants & Enums ---
-
-const (
-	StateChoosing = iota
-	StateTypingReply
-	StateTypingChoice
-)
-
-const (
-	StorageFile = "/data/conversationbot.json" // Path for Docker volume
-)
-
-// --- Structures ---
-
-// UserSession holds the state and data for a specific user.
-type UserSession struct {
-	State       int               `json:"state"`
-	CurrentKey  string            `json:"current_key,omitempty"` // Analogous to context.user_data["choice"]
-	UserData    map[string]string `json:"user_data"`
-	LastUpdated int64             `json:"last_updated"`
-}
-
-// ThreadSafeStorage handles concurrent access to user sessions and file persistence.
-type ThreadSafeStorage struct {
-	sync.RWMutex
-	Sessions map[int64]*UserSession `json:"sessions"`
-	FilePath string
-}
-
-// --- Storage Logic ---
-
-func NewStorage(filePath string) *ThreadSafeStorage {
-	storage := &ThreadSafeStorage{
-		Sessions: make(map[int64]*UserSession),
-		FilePath: filePath,
-	}
-	storage.Load()
-	return storage
-}
-
-func (s *ThreadSafeStorage) GetSession(userID int64) *UserSession {
-	s.RLock()
-	defer s.RUnlock()
-	if session, exists := s.Sessions[userID]; exists {
-		return session
-	}
-	return nil
-}
-
-func (s *ThreadSafeStorage) GetOrCreateSession(userID int64) *UserSession {
-	s.Lock()
-	defer s.Unlock()
-	if _, exists := s.Sessions[userID]; !exists {
-		s.Sessions[userID] = &UserSession{
-			State:    StateChoosing,
-			UserData: make(map[string]string),
-		}
-	}
-	return s.Sessions[userID]
-}
-
-// Save dumps the in-memory store to a JSON file.
-func (s *ThreadSafeStorage) Save() {
-	s.RLock()
-	defer s.RUnlock()
-
-	data, err := json.MarshalIndent(s.Sessions, "", "  ")
-	if err != nil {
-		log.Printf("[ERROR] Failed to marshal storage: %v", err)
-		return
-	}
-
-	// Simple write (in production, write to temp and rename is safer)
-	err = os.WriteFile(s.FilePath, data, 0644)
-	if err != nil {
-		log.Printf("[ERROR] Failed to save storage to file: %v", err)
-	} else {
-		log.Println("[INFO] Storage saved successfully.")
-	}
-}
-
-// Load reads the JSON file into memory.
-func (s *ThreadSafeStorage) Load() {
-	s.Lock()
-	defer s.Unlock()
-
-	data, err := os.ReadFile(s.FilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Println("[INFO] No existing storage file found. Starting fresh.")
-			return
-		}
-		log.Printf("[ERROR] Failed to read storage file: %v", err)
-		return
-	}
-
-	if len(data) == 0 {
-		return
-	}
-
-	err = json.Unmarshal(data, &s.Sessions)
-	if err != nil {
-		log.Printf("[ERROR] Failed to unmarshal storage: %v", err)
-		return
-	}
-	log.Printf("[INFO] Loaded %d sessions from disk.", len(s.Sessions))
-}
-
-// --- Keyboards ---
-
-var mainKeyboard = tgbotapi.NewReplyKeyboard(
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton("Age"),
-		tgbotapi.NewKeyboardButton("Favourite colour"),
-	),
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton("Number of siblings"),
-		tgbotapi.NewKeyboardButton("Something else..."),
-	),
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton("Done"),
-	),
-)
-
-// --- Helper Functions ---
-
-func factsToString(userData map[string]string) string {
-	var facts []string
-	for k, v := range userData {
-		facts = append(facts, fmt.Sprintf("%s - %s", k, v))
-	}
-	return strings.Join(facts, "\n")
-}
-
-// --- Bot Logic Handlers ---
-
-// handleStart initiates the conversation.
-func handleStart(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
-	reply := "Hi! My name is Doctor Botter."
-	if len(session.UserData) > 0 {
-		keys := make([]string, 0, len(session.UserData))
-		for k := range session.UserData {
-			keys = append(keys, k)
-		}
-		reply += fmt.Sprintf(" You already told me your %s. Why don't you tell me something more about yourself? Or change anything I already know.", strings.Join(keys, ", "))
-	} else {
-		reply += " I will hold a more complex conversation with you. Why don't you tell me something about yourself?"
-	}
-
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
-	msg.ReplyMarkup = mainKeyboard
-	bot.Send(msg)
-	session.State = StateChoosing
-}
-
-// handleRegularChoice handles predefined categories.
-func handleRegularChoice(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
-	text := strings.ToLower(update.Message.Text)
-	session.CurrentKey = text
-
-	var replyText string
-	if val, ok := session.UserData[text]; ok {
-		replyText = fmt.Sprintf("Your %s? I already know the following about that: %s", text, val)
-	} else {
-		replyText = fmt.Sprintf("Your %s? Yes, I would love to hear about that!", text)
-	}
-
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, replyText)
-	bot.Send(msg)
-	session.State = StateTypingReply
-}
-
-// handleCustomChoice asks for a custom category name.
-func handleCustomChoice(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Alright, please send me the category first, for example \"Most impressive skill\"")
-	bot.Send(msg)
-	session.State = StateTypingChoice
-}
-
-// handleReceivedInformation saves the user input.
-func handleReceivedInformation(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
-	text := update.Message.Text
-	category := session.CurrentKey
-	session.UserData[category] = strings.ToLower(text)
-	session.CurrentKey = "" // Clear temporary choice
-
-	msgText := fmt.Sprintf("Neat! Just so you know, this is what you already told me:\n%s\nYou can tell me more, or change your opinion on something.", factsToString(session.UserData))
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, msgText)
-	msg.ReplyMarkup = mainKeyboard
-	bot.Send(msg)
-	session.State = StateChoosing
-}
-
-// handleDone finishes the interaction.
-func handleDone(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
-	session.CurrentKey = ""
-	msgText := fmt.Sprintf("I learned these facts about you:\n%s\nUntil next time!", factsToString(session.UserData))
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, msgText)
-	msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-	bot.Send(msg)
-
-	// In the Python example, ConversationHandler.END is returned.
-	// Here we just reset state to Choosing (waiting for start) or keep it in Choosing but without a keyboard.
-	// To match persistence behavior strictly, we might leave the session active but waiting for /start.
-	// For this implementation, we reset to 'Choosing' logically for the next interaction,
-	// effectively waiting for a command or new text that matches filters.
-	session.State = StateChoosing
-}
-
-// handleShowData displays gathered info (command handler).
-func handleShowData(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
-	msgText := fmt.Sprintf("This is what you already told me:\n%s", factsToString(session.UserData))
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, msgText)
-	bot.Send(msg)
-}
-
-// ProcessUpdate routes the update based on state and content.
-// This function is separated for testability.
-func ProcessUpdate(update tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
-	if update.Message == nil {
-		return
-	}
-
-	text := update.Message.Text
-
-	// Global Commands
-	if update.Message.IsCommand() {
-		switch update.Message.Command() {
-		case "start":
-			handleStart(&update, session, bot)
-			return
-		case "show_data":
-			handleShowData(&update, session, bot)
-			return
-		}
-	}
-
-	// Regex Filters
-	isDone := regexp.MustCompile("(?i)^Done$").MatchString(text)
-	isRegular := regexp.MustCompile("^(Age|Favourite colour|Number of siblings)$").MatchString(text)
-	isCustom := regexp.MustCompile("^Something else...$").MatchString(text)
-
-	// State Machine
-	switch session.State {
-	case StateChoosing:
-		if isRegular {
-			handleRegularChoice(&update, session, bot)
-		} else if isCustom {
-			handleCustomChoice(&update, session, bot)
-		} else if isDone {
-			handleDone(&update, session, bot)
-		} else {
-			// Unknown input in Choosing state, re-show start or ignore
-			// Python bot ignores unknown text in CHOOSING usually unless it matches regex
-			log.Printf("[DEBUG] Ignored text in CHOOSING state: %s", text)
-		}
-
-	case StateTypingChoice:
-		// Python logic: The text entering here becomes the 'choice' (category)
-		// And we reuse 'regular_choice' logic which sets context.user_data["choice"]
-		// and moves to TYPING_REPLY
-		if !isDone { // Filter out "Done" if user changes mind? Python filters.TEXT & ~(COMMAND | Done)
-			// Treat this text as the category name
-			// Reuse regular_choice logic but purely for setting the key
-			session.CurrentKey = strings.ToLower(text)
-			replyText := fmt.Sprintf("Your %s? Yes, I would love to hear about that!", session.CurrentKey)
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, replyText)
-			bot.Send(msg)
-			session.State = StateTypingReply
-		} else {
-			handleRegularChoice(&update, session, bot) // Fallback if they clicked a button instead of typing?
-		}
-
-	case StateTypingReply:
-		if !isDone {
-			handleReceivedInformation(&update, session, bot)
-		} else {
-			handleDone(&update, session, bot)
-		}
-	}
-}
-
-// --- Main ---
-
-func main() {
-	token := os.Getenv("TELEGRAM_TOKEN")
-	if token == "" {
-		log.Fatal("TELEGRAM_TOKEN environment variable is required")
-	}
-
-	// Initialize Storage
-	// Ensure directory exists
-	if err := os.MkdirAll("/data", 0755); err != nil {
-		// Fallback for local run without docker volume mapping
-		log.Println("[WARN] Could not create /data, using current directory for storage")
-	}
-
-	storagePath := StorageFile
-	if _, err := os.Stat("/data"); os.IsNotExist(err) {
-		storagePath = "conversationbot.json"
-	}
-
-	storage := NewStorage(storagePath)
-
-	// Initialize Bot
-	bot, err := tgbotapi.NewBotAPI(token)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	bot.Debug = true
-	log.Printf("Authorized on account %s", bot.Self.UserName)
-
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-
-	updates := bot.GetUpdatesChan(u)
-
-	// Graceful Shutdown Channel
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-
-	go func() {
-		<-c
-		log.Println("[INFO] Interrupt received, saving storage...")
-		storage.Save()
-		os.Exit(0)
-	}()
-
-	// Main Loop
-	for update := range updates {
-		if update.Message == nil {
-			continue
-		}
-
-		userID := update.Message.From.ID
-		session := storage.GetOrCreateSession(userID)
-
-		log.Printf("[UPDATE] User: %s (%d) | Text: %s | Current State: %d", update.Message.From.UserName, userID, update.Message.Text, session.State)
-
-		ProcessUpdate(update, session, bot)
-
-		// Save on every update to ensure persistence (or use a ticker for performance)
-		storage.Save()
-	}
-}
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/unicode/norm"
+)
+
+// --- Constants & Enums ---
+
+const (
+	StateChoosing = iota
+	StateTypingReply
+	StateTypingChoice
+	StateTypingFeedback
+	StateQuestionnaire
+	StateTypingBatch
+	StateTutorial
+)
+
+// stateNames label states in metrics and events.
+var stateNames = map[int]string{
+	StateChoosing:       "choosing",
+	StateTypingReply:    "typing_reply",
+	StateTypingChoice:   "typing_choice",
+	StateTypingFeedback: "typing_feedback",
+	StateQuestionnaire:  "questionnaire",
+	StateTypingBatch:    "typing_batch",
+	StateTutorial:       "tutorial",
+}
+
+func stateName(state int) string {
+	if name, ok := stateNames[state]; ok {
+		return name
+	}
+	return strconv.Itoa(state)
+}
+
+const (
+	StorageFile = "/data/conversationbot.json" // Path for Docker volume
+)
+
+const (
+	// maxMessageTextBytes caps accepted text/caption size. Telegram allows 4096
+	// characters per message, which is at most 16 KiB of UTF-8.
+	maxMessageTextBytes = 16 * 1024
+	// maxQuarantineDumpBytes limits how much of a rejected update is logged.
+	maxQuarantineDumpBytes = 2048
+)
+
+// errUnsupportedUpdate marks well-formed updates of a type the bot does not handle (edits, callbacks, ...).
+var errUnsupportedUpdate = errors.New("unsupported update type")
+
+// adminChatID is the chat that receives /feedback and is allowed to run /admin commands.
+// Zero disables both. Set from the ADMIN_CHAT_ID environment variable.
+var adminChatID int64
+
+// store is the process-wide session storage, used by admin commands that look across users.
+var store *ThreadSafeStorage
+
+const (
+	TicketOpen   = "open"
+	TicketClosed = "closed"
+)
+
+// --- Structures ---
+
+// UserSession holds the state and data for a specific user.
+type UserSession struct {
+	State       int               `json:"state"`
+	CurrentKey  string            `json:"current_key,omitempty"` // Analogous to context.user_data["choice"]
+	UserData    map[string]string `json:"user_data"`
+	LastUpdated int64             `json:"last_updated"` // Unix time of the last processed update
+	// FirstSeen is when the session was created; zero for sessions older than the field.
+	FirstSeen int64 `json:"first_seen,omitempty"`
+	// AppliedUpdateIDs holds the most recent update_ids applied to this session, oldest
+	// first, capped at appliedUpdateWindow.
+	AppliedUpdateIDs []int `json:"applied_update_ids,omitempty"`
+	// FactUpdateIDs records which update_id last wrote each fact.
+	FactUpdateIDs map[string]int `json:"fact_update_ids,omitempty"`
+	Tickets       []*Ticket      `json:"tickets,omitempty"`
+	// Questionnaire and QuestionIndex track progress through a scripted flow (StateQuestionnaire).
+	// StateTutorial keeps its step in QuestionIndex.
+	Questionnaire string `json:"questionnaire,omitempty"`
+	QuestionIndex int    `json:"question_index,omitempty"`
+	// Suspended holds conversations interrupted by another flow, most recent last.
+	Suspended []Conversation `json:"suspended,omitempty"`
+	// ImportedAt and IntroSentAt are set by the import-users command.
+	ImportedAt  int64 `json:"imported_at,omitempty"`
+	IntroSentAt int64 `json:"intro_sent_at,omitempty"`
+	// Blocked is set when Telegram reports the user blocked the bot; nothing is sent to them while it is set.
+	Blocked bool `json:"blocked,omitempty"`
+	// SealedData is UserData encrypted with the user's data key. With encryption on it
+	// replaces UserData on disk; in memory it is only set while the facts cannot be opened.
+	SealedData string `json:"sealed_data,omitempty"`
+	// ConversationFlow names the active conversation ("main", "tutorial", "feedback",
+	// "batch" or "questionnaire/<command>") and ConversationStarted is when it began;
+	// both are empty when no conversation is running. Used for conversation metrics.
+	ConversationFlow    string `json:"conversation_flow,omitempty"`
+	ConversationStarted int64  `json:"conversation_started,omitempty"`
+	// RestartRemindedAt is when the user was last told their conversation survived a restart.
+	RestartRemindedAt int64 `json:"restart_reminded_at,omitempty"`
+	// TutorialOffered is set once the /tutorial hint was shown or the tutorial was started.
+	TutorialOffered bool `json:"tutorial_offered,omitempty"`
+}
+
+// Conversation is a snapshot of one in-progress flow. The active conversation lives
+// directly on UserSession (State, CurrentKey, ...); interrupted ones are pushed onto
+// UserSession.Suspended and restored when the interrupting flow ends.
+type Conversation struct {
+	State         int    `json:"state"`
+	CurrentKey    string `json:"current_key,omitempty"`
+	Questionnaire string `json:"questionnaire,omitempty"`
+	QuestionIndex int    `json:"question_index,omitempty"`
+	Flow          string `json:"flow,omitempty"`
+	Started       int64  `json:"started,omitempty"`
+}
+
+// maxSuspendedConversations bounds the stack; the oldest conversation is dropped beyond it.
+const maxSuspendedConversations = 5
+
+// Suspend pushes the active conversation onto the stack and resets the session to
+// StateChoosing. Nothing is pushed when the user is idle at the main menu and no
+// conversation is running.
+func (s *UserSession) Suspend() {
+	if s.State != StateChoosing || s.ConversationFlow != "" {
+		s.Suspended = append(s.Suspended, Conversation{
+			State:         s.State,
+			CurrentKey:    s.CurrentKey,
+			Questionnaire: s.Questionnaire,
+			QuestionIndex: s.QuestionIndex,
+			Flow:          s.ConversationFlow,
+			Started:       s.ConversationStarted,
+		})
+		if len(s.Suspended) > maxSuspendedConversations {
+			s.Suspended = s.Suspended[len(s.Suspended)-maxSuspendedConversations:]
+		}
+	}
+	s.reset()
+}
+
+// Resume pops the most recently suspended conversation and makes it active.
+// It reports false (leaving the session at StateChoosing) when the stack is empty.
+func (s *UserSession) Resume() bool {
+	s.reset()
+	if len(s.Suspended) == 0 {
+		return false
+	}
+	top := s.Suspended[len(s.Suspended)-1]
+	s.Suspended = s.Suspended[:len(s.Suspended)-1]
+	s.State = top.State
+	s.CurrentKey = top.CurrentKey
+	s.Questionnaire = top.Questionnaire
+	s.QuestionIndex = top.QuestionIndex
+	s.ConversationFlow = top.Flow
+	s.ConversationStarted = top.Started
+	return true
+}
+
+func (s *UserSession) reset() {
+	s.State = StateChoosing
+	s.CurrentKey = ""
+	s.Questionnaire = ""
+	s.QuestionIndex = 0
+	s.ConversationFlow = ""
+	s.ConversationStarted = 0
+}
+
+// Ticket is a piece of /feedback tracked until an admin closes it.
+// IDs have the form "<user_id>-<n>" so the owning session can be found from the ID alone.
+type Ticket struct {
+	ID        string `json:"id"`
+	Text      string `json:"text"`
+	Status    string `json:"status"`
+	Assignee  string `json:"assignee,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// ThreadSafeStorage handles concurrent access to user sessions and file persistence.
+type ThreadSafeStorage struct {
+	sync.RWMutex
+	Sessions map[int64]*UserSession `json:"sessions"`
+	FilePath string
+	// ReadOnly makes Save a no-op, for standby replicas that share the primary's data.
+	ReadOnly bool
+	// Compression is "" or "gzip". Reading detects gzip automatically, so it can be switched either way.
+	Compression string
+	// ShardDir, when set, stores each session in its own <user_id>.json file there
+	// instead of FilePath. FilePath is then only read once to migrate legacy data.
+	ShardDir string
+
+	keyring     *Keyring                    // When set, facts are encrypted per user on disk
+	alerts      []string                    // Problems found while loading, for the admin chat
+	integrity   []string                    // Checksum mismatches found while loading
+	saveMu      sync.Mutex                  // Serialises Save calls
+	shardHashes map[int64][sha256.Size]byte // Content last written per shard
+	fileSum     string                      // Hex SHA-256 of FilePath as last read or written
+}
+
+// --- Storage Logic ---
+
+func NewStorage(filePath string) *ThreadSafeStorage {
+	return openStorage(&ThreadSafeStorage{FilePath: filePath})
+}
+
+// NewShardedStorage creates a storage with one file per user under dir.
+// Sessions found in legacyPath are migrated into shards on first start.
+func NewShardedStorage(dir, legacyPath string) *ThreadSafeStorage {
+	return openStorage(&ThreadSafeStorage{FilePath: legacyPath, ShardDir: dir})
+}
+
+// openStorage loads a storage configured with FilePath, ShardDir and ReadOnly. ReadOnly
+// must already be set: a replica shares the primary's volume, so it never creates the
+// shard directory, migrates the legacy file or quarantines anything while loading.
+func openStorage(storage *ThreadSafeStorage) *ThreadSafeStorage {
+	storage.Sessions = make(map[int64]*UserSession)
+	if storage.ShardDir == "" {
+		storage.Load()
+		return storage
+	}
+
+	if !storage.ReadOnly {
+		if err := os.MkdirAll(storage.ShardDir, 0755); err != nil {
+			log.Printf("[ERROR] Failed to create shard directory %s: %v", storage.ShardDir, err)
+		}
+	}
+	storage.Load()
+
+	if len(storage.Sessions) == 0 {
+		if _, err := os.Stat(storage.FilePath); err == nil {
+			if storage.ReadOnly {
+				// Serve the unmigrated file as-is; the primary migrates it.
+				storage.loadFile()
+				return storage
+			}
+			log.Printf("[INFO] Migrating %s into per-user shards under %s", storage.FilePath, storage.ShardDir)
+			storage.loadFile()
+			if storage.Save() {
+				if err := os.Rename(storage.FilePath, storage.FilePath+".migrated"); err != nil {
+					log.Printf("[WARN] Migrated sessions but could not rename %s: %v", storage.FilePath, err)
+				}
+			}
+		}
+	}
+	return storage
+}
+
+func (s *ThreadSafeStorage) GetSession(userID int64) *UserSession {
+	s.RLock()
+	defer s.RUnlock()
+	if session, exists := s.Sessions[userID]; exists {
+		return session
+	}
+	return nil
+}
+
+func (s *ThreadSafeStorage) GetOrCreateSession(userID int64) *UserSession {
+	s.Lock()
+	defer s.Unlock()
+	if _, exists := s.Sessions[userID]; !exists {
+		s.Sessions[userID] = &UserSession{
+			State:     StateChoosing,
+			UserData:  make(map[string]string),
+			FirstSeen: time.Now().Unix(),
+		}
+	}
+	return s.Sessions[userID]
+}
+
+// FindTicket looks up a ticket by ID and returns it together with its owner's user ID.
+func (s *ThreadSafeStorage) FindTicket(ticketID string) (int64, *Ticket) {
+	owner, _, ok := strings.Cut(ticketID, "-")
+	if !ok {
+		return 0, nil
+	}
+	userID, err := strconv.ParseInt(owner, 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	session, exists := s.Sessions[userID]
+	if !exists {
+		return 0, nil
+	}
+	for _, ticket := range session.Tickets {
+		if ticket.ID == ticketID {
+			return userID, ticket
+		}
+	}
+	return 0, nil
+}
+
+// OpenTickets returns every ticket that has not been closed, oldest first.
+func (s *ThreadSafeStorage) OpenTickets() []*Ticket {
+	s.RLock()
+	defer s.RUnlock()
+	var tickets []*Ticket
+	for _, session := range s.Sessions {
+		for _, ticket := range session.Tickets {
+			if ticket.Status != TicketClosed {
+				tickets = append(tickets, ticket)
+			}
+		}
+	}
+	sort.Slice(tickets, func(i, j int) bool { return tickets[i].CreatedAt < tickets[j].CreatedAt })
+	return tickets
+}
+
+// BlockedCount returns how many sessions are flagged as having blocked the bot.
+func (s *ThreadSafeStorage) BlockedCount() int {
+	s.RLock()
+	defer s.RUnlock()
+	count := 0
+	for _, session := range s.Sessions {
+		if session.Blocked {
+			count++
+		}
+	}
+	return count
+}
+
+// Save dumps the in-memory store to disk and reports whether everything was written.
+func (s *ThreadSafeStorage) Save() bool {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.ReadOnly {
+		log.Println("[DEBUG] Storage is read-only, skipping save.")
+		return true
+	}
+	if s.ShardDir != "" {
+		return s.saveShards()
+	}
+
+	sessions := s.Sessions
+	if s.keyring != nil {
+		sessions = make(map[int64]*UserSession, len(s.Sessions))
+		for userID, session := range s.Sessions {
+			sealed, err := s.sealForDisk(userID, session)
+			if err != nil {
+				log.Printf("[ERROR] Failed to encrypt session %d: %v", userID, err)
+				return false
+			}
+			sessions[userID] = sealed
+		}
+		// New data keys must be on disk before anything encrypted with them.
+		if err := s.keyring.Flush(); err != nil {
+			log.Printf("[ERROR] Failed to save keyring: %v", err)
+			return false
+		}
+	}
+
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal storage: %v", err)
+		return false
+	}
+	if data, err = s.encode(data); err != nil {
+		log.Printf("[ERROR] Failed to compress storage: %v", err)
+		return false
+	}
+
+	// The data and its checksum are two renames, so the checksum file first lists both
+	// the new and the current sum: whichever file a crash leaves behind still verifies.
+	name := filepath.Base(s.FilePath)
+	newSum := sha256.Sum256(data)
+	sum := hex.EncodeToString(newSum[:])
+	if s.fileSum != "" && s.fileSum != sum {
+		if err := writeFileAtomic(checksumPath(s.FilePath), []byte(checksumLine(sum, name)+checksumLine(s.fileSum, name))); err != nil {
+			log.Printf("[ERROR] Failed to save storage checksum: %v", err)
+			return false
+		}
+	}
+	// Write to a temp file and rename so a crash mid-write never leaves a truncated file.
+	err = writeFileAtomic(s.FilePath, data)
+	if err != nil {
+		log.Printf("[ERROR] Failed to save storage to file: %v", err)
+		return false
+	}
+	s.fileSum = sum
+	if err := writeFileAtomic(checksumPath(s.FilePath), []byte(checksumLine(sum, name))); err != nil {
+		log.Printf("[ERROR] Failed to save storage checksum: %v", err)
+		return false
+	}
+	log.Println("[INFO] Storage saved successfully.")
+	return true
+}
+
+// saveShards rewrites only the shards whose content changed since they were last written.
+// Callers hold saveMu and the read lock.
+func (s *ThreadSafeStorage) saveShards() bool {
+	if s.shardHashes == nil {
+		s.shardHashes = make(map[int64][sha256.Size]byte)
+	}
+
+	type shard struct {
+		userID int64
+		data   []byte
+		sum    [sha256.Size]byte
+	}
+	ok := true
+	var changed []shard
+	for userID, session := range s.Sessions {
+		session, err := s.sealForDisk(userID, session)
+		var data []byte
+		if err == nil {
+			data, err = json.MarshalIndent(session, "", "  ")
+		}
+		if err == nil {
+			data, err = s.encode(data)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to encode session %d: %v", userID, err)
+			ok = false
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if prev, seen := s.shardHashes[userID]; seen && prev == sum {
+			continue
+		}
+		changed = append(changed, shard{userID, data, sum})
+	}
+	if len(changed) == 0 {
+		return ok
+	}
+	// New data keys must be on disk before anything encrypted with them.
+	if s.keyring != nil {
+		if err := s.keyring.Flush(); err != nil {
+			log.Printf("[ERROR] Failed to save keyring: %v", err)
+			return false
+		}
+	}
+	// List the new sums next to the current ones before touching any shard, so a
+	// crash part-way through leaves every shard matching one of them.
+	pending := make(map[int64][sha256.Size]byte, len(changed))
+	for _, c := range changed {
+		pending[c.userID] = c.sum
+	}
+	if err := s.writeManifest(pending); err != nil {
+		log.Printf("[ERROR] Failed to save shard manifest: %v", err)
+		return false
+	}
+
+	written := 0
+	for _, c := range changed {
+		if err := writeFileAtomic(s.shardPath(c.userID), c.data); err != nil {
+			log.Printf("[ERROR] Failed to save session %d: %v", c.userID, err)
+			ok = false
+			continue
+		}
+		s.shardHashes[c.userID] = c.sum
+		written++
+	}
+	log.Printf("[INFO] Saved %d changed session shard(s).", written)
+	if err := s.writeManifest(nil); err != nil {
+		log.Printf("[ERROR] Failed to save shard manifest: %v", err)
+		ok = false
+	}
+	return ok
+}
+
+// quarantineShard moves a corrupt shard into ShardDir/quarantine so the user's next
+// save starts a fresh file without destroying the damaged one. Callers hold the write lock.
+func (s *ThreadSafeStorage) quarantineShard(name string, cause error) {
+	if s.ReadOnly {
+		return // A replica must not touch the shared volume; the primary handles quarantine.
+	}
+	dir := filepath.Join(s.ShardDir, "quarantine")
+	target := filepath.Join(dir, fmt.Sprintf("%s.%s", name, time.Now().UTC().Format("20060102T150405Z")))
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.Rename(filepath.Join(s.ShardDir, name), target)
+	}
+	if err != nil {
+		s.ReadOnly = true
+		s.alert("Session shard %s is corrupt (%v) and could not be quarantined (%v). Storage is now READ-ONLY to protect it.", name, cause, err)
+		return
+	}
+	s.alert("Session shard %s was corrupt (%v) and moved to %s. That user starts fresh.", name, cause, target)
+}
+
+func (s *ThreadSafeStorage) shardPath(userID int64) string {
+	return filepath.Join(s.ShardDir, strconv.FormatInt(userID, 10)+".json")
+}
+
+// writeFileAtomic writes via a temp file and rename so a crash never leaves a half-written file.
+func writeFileAtomic(path string, data []byte) error {
+	if faultsEnabled() && faults.StorageWrite != nil {
+		if err := faults.StorageWrite(path); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads the JSON file (or the shard directory) into memory. A read-only replica
+// also re-reads the keyring, so it can open facts sealed with keys the primary added.
+func (s *ThreadSafeStorage) Load() {
+	if s.ReadOnly && s.keyring != nil {
+		if err := s.keyring.Reload(); err != nil {
+			log.Printf("[ERROR] Failed to reload keyring: %v", err)
+		}
+	}
+	if s.ShardDir != "" {
+		s.loadShards()
+		return
+	}
+	s.loadFile()
+}
+
+func (s *ThreadSafeStorage) loadFile() {
+	s.Lock()
+	defer s.Unlock()
+
+	data, err := os.ReadFile(s.FilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Println("[INFO] No existing storage file found. Starting fresh.")
+			return
+		}
+		log.Printf("[ERROR] Failed to read storage file: %v", err)
+		return
+	}
+
+	if len(data) == 0 {
+		return
+	}
+
+	s.verifyChecksum(data)
+
+	decoded, err := decodeStored(data)
+	if err == nil {
+		err = json.Unmarshal(decoded, &s.Sessions)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to unmarshal storage: %v", err)
+		s.recoverCorruptFile(data, decoded, err)
+	}
+	for userID, session := range s.Sessions {
+		s.unseal(userID, session)
+		normalizeSessionFacts(session)
+	}
+	log.Printf("[INFO] Loaded %d sessions from disk.", len(s.Sessions))
+}
+
+// recoverCorruptFile preserves a corrupt storage file under a quarantine name and
+// salvages every session that still parses. If the copy cannot be made the storage
+// is switched to read-only so the next Save cannot destroy the only copy.
+// Callers hold the write lock.
+func (s *ThreadSafeStorage) recoverCorruptFile(raw, decoded []byte, cause error) {
+	if s.ReadOnly {
+		// A replica must not write to the shared volume; the primary handles quarantine.
+		recovered, skipped := recoverSessions(decoded)
+		s.Sessions = recovered
+		log.Printf("[WARN] Read-only storage loaded %d session(s) from a corrupt file, %d unreadable.", len(recovered), skipped)
+		return
+	}
+
+	quarantine := fmt.Sprintf("%s.corrupt-%s", s.FilePath, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.WriteFile(quarantine, raw, 0644); err != nil {
+		s.ReadOnly = true
+		s.alert("Storage file %s is corrupt (%v) and could not be quarantined (%v). Storage is now READ-ONLY to protect it; fix the file and restart.", s.FilePath, cause, err)
+	}
+
+	recovered, skipped := recoverSessions(decoded)
+	s.Sessions = recovered
+	if !s.ReadOnly {
+		s.alert("Storage file %s was corrupt (%v). Original kept at %s; recovered %d session(s), %d unreadable.", s.FilePath, cause, quarantine, len(recovered), skipped)
+	}
+}
+
+// recoverSessions extracts as many sessions as possible from a damaged
+// {"<user_id>": {...}, ...} document. Entries that fail to decode are counted in
+// skipped; a truncated document yields everything before the damage.
+func recoverSessions(data []byte) (recovered map[int64]*UserSession, skipped int) {
+	recovered = make(map[int64]*UserSession)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return recovered, 0
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return recovered, skipped + 1
+		}
+		key, _ := tok.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return recovered, skipped + 1 // Syntax damage: nothing after this point is reliable
+		}
+		userID, err := strconv.ParseInt(key, 10, 64)
+		var session UserSession
+		if err != nil || json.Unmarshal(raw, &session) != nil {
+			skipped++
+			continue
+		}
+		if session.UserData == nil {
+			session.UserData = make(map[string]string)
+		}
+		recovered[userID] = &session
+	}
+	return recovered, skipped
+}
+
+// alert logs a storage problem and keeps it for the admin chat. Callers hold the write lock.
+func (s *ThreadSafeStorage) alert(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("[ERROR] %s", msg)
+	s.alerts = append(s.alerts, msg)
+}
+
+// TakeAlerts returns and clears the problems recorded while loading.
+func (s *ThreadSafeStorage) TakeAlerts() []string {
+	s.Lock()
+	defer s.Unlock()
+	alerts := s.alerts
+	s.alerts = nil
+	return alerts
+}
+
+// loadShards reads every <user_id>.json in ShardDir. A shard that cannot be read
+// or parsed is skipped without affecting the others.
+func (s *ThreadSafeStorage) loadShards() {
+	s.Lock()
+	defer s.Unlock()
+
+	entries, err := os.ReadDir(s.ShardDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Println("[INFO] No existing shard directory found. Starting fresh.")
+			return
+		}
+		log.Printf("[ERROR] Failed to read shard directory: %v", err)
+		return
+	}
+
+	manifest := s.readManifest()
+	listed := make(map[string]bool, len(entries))
+	if s.shardHashes == nil {
+		s.shardHashes = make(map[int64][sha256.Size]byte)
+	}
+
+	loaded := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".json" {
+			continue
+		}
+		userID, err := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.ShardDir, name))
+		if err != nil {
+			log.Printf("[ERROR] Failed to read shard %s: %v", name, err)
+			continue
+		}
+		listed[name] = true
+		sum := sha256.Sum256(data)
+		if want, ok := manifest[name]; ok && !matchesChecksum(strings.Fields(want), sum) {
+			s.integrity = append(s.integrity, fmt.Sprintf("shard %s does not match its checksum in %s", name, shardManifestName))
+		}
+		var session UserSession
+		decoded, err := decodeStored(data)
+		if err == nil {
+			err = json.Unmarshal(decoded, &session)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to unmarshal shard %s: %v", name, err)
+			s.quarantineShard(name, err)
+			continue
+		}
+		s.shardHashes[userID] = sum
+		if session.UserData == nil {
+			session.UserData = make(map[string]string)
+		}
+		s.unseal(userID, &session)
+		normalizeSessionFacts(&session)
+		s.Sessions[userID] = &session
+		loaded++
+	}
+	for name := range manifest {
+		if !listed[name] {
+			s.integrity = append(s.integrity, fmt.Sprintf("shard %s is listed in %s but missing", name, shardManifestName))
+		}
+	}
+	log.Printf("[INFO] Loaded %d sessions from %s.", loaded, s.ShardDir)
+}
+
+// --- Envelope Encryption ---
+
+// errKeyErased means a user's data key was deliberately deleted, so their facts are gone for good.
+var errKeyErased = errors.New("data key has been erased")
+
+// errKeyMissing means the keyring has no key for the user and no record of erasing
+// one, e.g. a stale or wrong keys file. The facts may still be recoverable.
+var errKeyMissing = errors.New("data key not found in keyring")
+
+// Keyring holds one random data key per user, each wrapped by the master key and kept
+// in a separate file. Facts are encrypted with the user's data key, so Forget makes
+// every copy of them unreadable, including old snapshots.
+type Keyring struct {
+	mu      sync.Mutex
+	master  cipher.AEAD
+	path    string
+	wrapped map[int64]string      // base64(nonce || data key sealed by master)
+	erased  map[int64]int64       // Tombstones: unix time each forgotten key was deleted, kept after a new key is made
+	keys    map[int64]cipher.AEAD // Unwrapped data keys
+	sealed  map[int64]sealedFacts // Last ciphertext per user, reused while facts are unchanged
+	dirty   bool
+}
+
+// keyringFile is the on-disk form of a Keyring. Files written before tombstones
+// existed are a bare map of wrapped keys.
+type keyringFile struct {
+	Keys   map[int64]string `json:"keys"`
+	Erased map[int64]int64  `json:"erased"`
+}
+
+// secretFields are the parts of a session sealed with the user's data key: the facts
+// and everything that names their categories.
+type secretFields struct {
+	UserData      map[string]string `json:"user_data"`
+	FactUpdateIDs map[string]int    `json:"fact_update_ids,omitempty"`
+	CurrentKey    string            `json:"current_key,omitempty"`
+	Suspended     []Conversation    `json:"suspended,omitempty"`
+}
+
+// sealedFacts lets an unchanged session serialize to the same bytes, which keeps
+// the sharded store from rewriting every shard on every save.
+type sealedFacts struct {
+	sum  [sha256.Size]byte
+	blob string
+}
+
+// NewKeyring loads the wrapped data keys from path. A missing file is an empty keyring.
+func NewKeyring(masterKey []byte, path string) (*Keyring, error) {
+	master, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("master key: %w", err)
+	}
+	k := &Keyring{master: master, path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads the keys file, for read-only replicas following a primary that adds
+// and erases keys. Unsaved keys are discarded, so only call it when nothing is written.
+func (k *Keyring) Reload() error {
+	file := keyringFile{Keys: make(map[int64]string), Erased: make(map[int64]int64)}
+	data, err := os.ReadFile(k.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &file); err != nil || file.Keys == nil {
+			file = keyringFile{Keys: make(map[int64]string)}
+			if err := json.Unmarshal(data, &file.Keys); err != nil {
+				return fmt.Errorf("%s is corrupt: %w", k.path, err)
+			}
+		}
+		if file.Erased == nil {
+			file.Erased = make(map[int64]int64)
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.wrapped, k.erased = file.Keys, file.Erased
+	k.keys = make(map[int64]cipher.AEAD)
+	k.sealed = make(map[int64]sealedFacts)
+	k.dirty = false
+	return nil
+}
+
+// parseMasterKey accepts a 32-byte key as hex or standard base64.
+func parseMasterKey(value string) ([]byte, error) {
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("must be 32 bytes, hex or base64 encoded")
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// userAAD binds ciphertext to its owner so blobs cannot be swapped between users.
+func userAAD(userID int64) []byte {
+	return []byte(strconv.FormatInt(userID, 10))
+}
+
+func sealBlob(aead cipher.AEAD, plaintext, aad []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, aad)), nil
+}
+
+func openBlob(aead cipher.AEAD, blob string, aad []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// dataKey returns the user's data key, creating one when create is set. Callers hold k.mu.
+func (k *Keyring) dataKey(userID int64, create bool) (cipher.AEAD, error) {
+	if aead, ok := k.keys[userID]; ok {
+		return aead, nil
+	}
+	var raw []byte
+	if wrapped, ok := k.wrapped[userID]; ok {
+		var err error
+		if raw, err = openBlob(k.master, wrapped, userAAD(userID)); err != nil {
+			return nil, fmt.Errorf("unwrap data key: %w", err)
+		}
+	} else if create {
+		raw = make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		wrapped, err := sealBlob(k.master, raw, userAAD(userID))
+		if err != nil {
+			return nil, err
+		}
+		k.wrapped[userID] = wrapped
+		k.dirty = true
+	} else if _, ok := k.erased[userID]; ok {
+		return nil, errKeyErased
+	} else {
+		return nil, errKeyMissing
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	k.keys[userID] = aead
+	return aead, nil
+}
+
+// Seal encrypts a user's secret fields with their data key.
+func (k *Keyring) Seal(userID int64, secrets secretFields) (string, error) {
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(plaintext)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if cached, ok := k.sealed[userID]; ok && cached.sum == sum {
+		return cached.blob, nil
+	}
+	aead, err := k.dataKey(userID, true)
+	if err != nil {
+		return "", err
+	}
+	blob, err := sealBlob(aead, plaintext, userAAD(userID))
+	if err != nil {
+		return "", err
+	}
+	k.sealed[userID] = sealedFacts{sum: sum, blob: blob}
+	return blob, nil
+}
+
+// Open decrypts fields sealed by Seal. It returns errKeyErased for blobs sealed with
+// a forgotten key and errKeyMissing when the keyring never had one.
+func (k *Keyring) Open(userID int64, blob string) (secretFields, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var secrets secretFields
+	aead, err := k.dataKey(userID, false)
+	if err != nil {
+		return secrets, err
+	}
+	plaintext, err := openBlob(aead, blob, userAAD(userID))
+	if err != nil {
+		// The tombstone outlives the user's next key, so a blob that key cannot open
+		// was sealed before the erase, e.g. in a restored snapshot.
+		if _, ok := k.erased[userID]; ok {
+			return secrets, errKeyErased
+		}
+		return secrets, err
+	}
+	// Older blobs hold only the facts map; the current form always has an object value.
+	if err := json.Unmarshal(plaintext, &secrets.UserData); err != nil {
+		secrets = secretFields{}
+		if err := json.Unmarshal(plaintext, &secrets); err != nil {
+			return secrets, err
+		}
+	}
+	if secrets.UserData == nil {
+		secrets.UserData = make(map[string]string)
+	}
+	k.sealed[userID] = sealedFacts{sum: sha256.Sum256(plaintext), blob: blob}
+	return secrets, nil
+}
+
+// Forget deletes the user's data key, leaves a tombstone so their sealed facts are
+// known to be erased rather than missing, and writes the keyring straight away.
+func (k *Keyring) Forget(userID int64) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.wrapped, userID)
+	delete(k.keys, userID)
+	delete(k.sealed, userID)
+	k.erased[userID] = time.Now().Unix()
+	k.dirty = true
+	return k.flushLocked()
+}
+
+// Flush writes the keyring if keys were added since the last write.
+func (k *Keyring) Flush() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.flushLocked()
+}
+
+func (k *Keyring) flushLocked() error {
+	if !k.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(keyringFile{Keys: k.wrapped, Erased: k.erased}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(k.path, data); err != nil {
+		return err
+	}
+	k.dirty = false
+	return nil
+}
+
+// UseKeyring turns on per-user encryption and opens the sessions already loaded.
+// With a nil keyring, sealed sessions are reported as integrity errors instead,
+// since saving over them without the key would lose those facts.
+func (s *ThreadSafeStorage) UseKeyring(k *Keyring) {
+	s.Lock()
+	defer s.Unlock()
+	s.keyring = k
+	for userID, session := range s.Sessions {
+		if k == nil {
+			if session.SealedData != "" {
+				s.integrity = append(s.integrity, fmt.Sprintf("facts for user %d are encrypted but no master key is configured", userID))
+			}
+			continue
+		}
+		s.unseal(userID, session)
+		normalizeSessionFacts(session)
+	}
+}
+
+// unseal decrypts session.SealedData back into the session. Facts whose key was
+// erased are dropped; any other failure, including a key that is simply missing,
+// leaves the sealed blob in place so it is saved unchanged. Callers hold the write lock.
+func (s *ThreadSafeStorage) unseal(userID int64, session *UserSession) {
+	if s.keyring == nil || session.SealedData == "" {
+		return
+	}
+	secrets, err := s.keyring.Open(userID, session.SealedData)
+	switch {
+	case errors.Is(err, errKeyErased):
+		log.Printf("[INFO] Data key of user %d was erased, dropping their sealed facts", userID)
+		secrets = secretFields{UserData: make(map[string]string)}
+	case err != nil:
+		s.integrity = append(s.integrity, fmt.Sprintf("cannot decrypt facts for user %d: %v", userID, err))
+		return
+	}
+	session.UserData = secrets.UserData
+	session.FactUpdateIDs = secrets.FactUpdateIDs
+	session.CurrentKey = secrets.CurrentKey
+	session.Suspended = secrets.Suspended
+	session.SealedData = ""
+}
+
+// sealForDisk returns the form of session to write: a copy with its secretFields
+// encrypted when a keyring is set, otherwise the session itself. Callers hold the read lock.
+func (s *ThreadSafeStorage) sealForDisk(userID int64, session *UserSession) (*UserSession, error) {
+	if s.keyring == nil || session.SealedData != "" {
+		return session, nil
+	}
+	sealed := *session
+	sealed.UserData = map[string]string{}
+	sealed.FactUpdateIDs = nil
+	sealed.CurrentKey = ""
+	sealed.Suspended = nil
+	if len(session.UserData) > 0 || session.CurrentKey != "" || len(session.Suspended) > 0 {
+		blob, err := s.keyring.Seal(userID, secretFields{
+			UserData:      session.UserData,
+			FactUpdateIDs: session.FactUpdateIDs,
+			CurrentKey:    session.CurrentKey,
+			Suspended:     session.Suspended,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sealed.SealedData = blob
+	}
+	return &sealed, nil
+}
+
+// EraseFacts crypto-shreds a user's facts: their data key is deleted, so the
+// ciphertext left in older files can never be decrypted, and the facts are cleared
+// along with the conversation state that names their categories.
+func (s *ThreadSafeStorage) EraseFacts(userID int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.keyring == nil {
+		return errors.New("storage encryption is not enabled")
+	}
+	if err := s.keyring.Forget(userID); err != nil {
+		return err
+	}
+	if session := s.Sessions[userID]; session != nil {
+		session.UserData = make(map[string]string)
+		session.FactUpdateIDs = nil
+		session.SealedData = ""
+		session.Suspended = nil
+		session.reset()
+	}
+	log.Printf("[INFO] Erased data key and facts of user %d", userID)
+	return nil
+}
+
+// --- Compression ---
+
+// encode compresses serialized data according to s.Compression.
+func (s *ThreadSafeStorage) encode(data []byte) ([]byte, error) {
+	switch s.Compression {
+	case "":
+		return data, nil
+	case "gzip":
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf) // No ModTime, so equal input gives equal bytes for the shard cache
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", s.Compression)
+}
+
+// decodeStored returns the JSON inside data, decompressing it if it is gzip.
+// For a damaged gzip stream it returns whatever was decompressed before the error.
+func decodeStored(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("open gzip: %w", err)
+	}
+	decoded, err := io.ReadAll(zr)
+	if err != nil {
+		return decoded, fmt.Errorf("decompress: %w", err)
+	}
+	return decoded, nil
+}
+
+// --- Integrity ---
+
+// shardManifestName is the file in ShardDir mapping shard names to their SHA-256.
+const shardManifestName = "MANIFEST.json"
+
+// checksumPath is where the single-file checksum lives, in sha256sum format.
+func checksumPath(path string) string { return path + ".sha256" }
+
+func checksumLine(sum, name string) string {
+	return fmt.Sprintf("%s  %s\n", sum, name)
+}
+
+// matchesChecksum reports whether sum is one of the accepted hex digests. A save in
+// progress lists both the old and the new digest of the files it is replacing.
+func matchesChecksum(accepted []string, sum [sha256.Size]byte) bool {
+	got := hex.EncodeToString(sum[:])
+	for _, want := range accepted {
+		if want == got {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyChecksum compares data against the stored checksum, if there is one.
+// Files written before checksums existed have none and are accepted. Callers hold the write lock.
+func (s *ThreadSafeStorage) verifyChecksum(data []byte) {
+	sum := sha256.Sum256(data)
+	s.fileSum = hex.EncodeToString(sum[:])
+	stored, err := os.ReadFile(checksumPath(s.FilePath))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.integrity = append(s.integrity, fmt.Sprintf("cannot read checksum for %s: %v", s.FilePath, err))
+		}
+		return
+	}
+	var accepted []string
+	for _, line := range strings.Split(strings.TrimSpace(string(stored)), "\n") {
+		want, _, _ := strings.Cut(line, " ")
+		accepted = append(accepted, want)
+	}
+	if !matchesChecksum(accepted, sum) {
+		s.integrity = append(s.integrity, fmt.Sprintf("%s does not match its checksum %s", s.FilePath, checksumPath(s.FilePath)))
+	}
+}
+
+func (s *ThreadSafeStorage) readManifest() map[string]string {
+	manifest := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(s.ShardDir, shardManifestName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.integrity = append(s.integrity, fmt.Sprintf("cannot read %s: %v", shardManifestName, err))
+		}
+		return manifest
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		s.integrity = append(s.integrity, fmt.Sprintf("%s is corrupt: %v", shardManifestName, err))
+	}
+	return manifest
+}
+
+// writeManifest records the checksum of every shard last written or loaded. Shards in
+// pending are about to be rewritten: they list the new checksum before the current one.
+// New shards stay unlisted until written, since unlisted shards are accepted as-is.
+// Callers hold saveMu.
+func (s *ThreadSafeStorage) writeManifest(pending map[int64][sha256.Size]byte) error {
+	manifest := make(map[string]string, len(s.shardHashes)+len(pending))
+	for userID, sum := range s.shardHashes {
+		manifest[filepath.Base(s.shardPath(userID))] = hex.EncodeToString(sum[:])
+	}
+	for userID, sum := range pending {
+		name := filepath.Base(s.shardPath(userID))
+		if current, ok := manifest[name]; ok {
+			manifest[name] = hex.EncodeToString(sum[:]) + " " + current
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.ShardDir, shardManifestName), data)
+}
+
+// IntegrityErrors returns and clears the checksum mismatches found by the last Load.
+func (s *ThreadSafeStorage) IntegrityErrors() []string {
+	s.Lock()
+	defer s.Unlock()
+	problems := s.integrity
+	s.integrity = nil
+	return problems
+}
+
+// checkIntegrity logs the problems found while loading storage and fails unless force
+// is set, since writing over data that failed its check could destroy the evidence.
+func checkIntegrity(storage *ThreadSafeStorage, force bool) error {
+	problems := storage.IntegrityErrors()
+	if len(problems) == 0 {
+		return nil
+	}
+	for _, problem := range problems {
+		log.Printf("[ERROR] Integrity check failed: %s", problem)
+	}
+	if !force {
+		return errors.New("refusing to use data that failed its integrity check; inspect the files, then rerun with --force to accept them")
+	}
+	log.Println("[WARN] --force given, continuing despite integrity errors")
+	return nil
+}
+
+// --- Update Validation ---
+
+// validateUpdate checks that an update carries everything the handlers dereference
+// before it is routed. Anything it rejects is skipped rather than handled.
+func validateUpdate(update tgbotapi.Update) error {
+	if update.Message == nil {
+		return errUnsupportedUpdate
+	}
+	msg := update.Message
+	if msg.From == nil {
+		return errors.New("message has no sender")
+	}
+	if msg.Chat == nil {
+		return errors.New("message has no chat")
+	}
+	if len(msg.Text) > maxMessageTextBytes {
+		return fmt.Errorf("message text is %d bytes, limit is %d", len(msg.Text), maxMessageTextBytes)
+	}
+	if len(msg.Caption) > maxMessageTextBytes {
+		return fmt.Errorf("message caption is %d bytes, limit is %d", len(msg.Caption), maxMessageTextBytes)
+	}
+	return nil
+}
+
+// quarantineUpdate logs a rejected update (truncated) so it can be inspected later.
+func quarantineUpdate(update tgbotapi.Update, reason error) {
+	dump, err := json.Marshal(update)
+	if err != nil {
+		dump = []byte(fmt.Sprintf("<unmarshalable: %v>", err))
+	}
+	if len(dump) > maxQuarantineDumpBytes {
+		dump = append(dump[:maxQuarantineDumpBytes], "..."...)
+	}
+	log.Printf("[WARN] Quarantined update %d: %v | Raw: %s", update.UpdateID, reason, dump)
+}
+
+// --- ID Obfuscation ---
+
+// IDObfuscator turns a Telegram user ID into the identifier shown to downstream
+// systems (analytics, exports). Implementations must be deterministic.
+type IDObfuscator interface {
+	Obfuscate(userID int64) string
+}
+
+// plainIDs passes user IDs through unchanged.
+type plainIDs struct{}
+
+func (plainIDs) Obfuscate(userID int64) string { return strconv.FormatInt(userID, 10) }
+
+// hashedIDs replaces user IDs with a keyed HMAC-SHA256 hex digest.
+type hashedIDs struct{ secret []byte }
+
+func (h hashedIDs) Obfuscate(userID int64) string {
+	return hex.EncodeToString(h.sum(userID))
+}
+
+func (h hashedIDs) sum(userID int64) []byte {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(strconv.FormatInt(userID, 10)))
+	return mac.Sum(nil)
+}
+
+// tokenIDs replaces user IDs with short "u_" tokens derived from the same HMAC,
+// for sinks that limit identifier length.
+type tokenIDs struct{ hashedIDs }
+
+func (t tokenIDs) Obfuscate(userID int64) string {
+	return "u_" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(t.sum(userID)[:10]))
+}
+
+// idObfuscator defaults to raw IDs; main configures it from ID_OBFUSCATION.
+var idObfuscator IDObfuscator = plainIDs{}
+
+// newIDObfuscator builds the obfuscator for mode "none", "hash" or "token".
+func newIDObfuscator(mode, secret string) (IDObfuscator, error) {
+	switch mode {
+	case "", "none":
+		return plainIDs{}, nil
+	case "hash", "token":
+		if len(secret) < 16 {
+			return nil, errors.New("ID_OBFUSCATION_SECRET must be at least 16 characters")
+		}
+		if mode == "hash" {
+			return hashedIDs{[]byte(secret)}, nil
+		}
+		return tokenIDs{hashedIDs{[]byte(secret)}}, nil
+	}
+	return nil, fmt.Errorf("unknown ID_OBFUSCATION %q (want none, hash or token)", mode)
+}
+
+// --- Analytics ---
+
+const (
+	EventSessionStarted = "session_started"
+	EventFactSaved      = "fact_saved"
+	EventDone           = "done"
+	EventCommandUsed    = "command_used"
+	EventTutorial       = "tutorial"
+	// EventConversation is sent when a conversation is finished with /done, completes
+	// or is cancelled.
+	EventConversation = "conversation_completed"
+)
+
+// AnalyticsEvent is a single tracked event. DistinctID is the user ID after obfuscation.
+type AnalyticsEvent struct {
+	Name       string
+	DistinctID string
+	Properties map[string]string
+	Time       time.Time
+}
+
+// AnalyticsHook receives key conversation events. Track must not block the update loop.
+type AnalyticsHook interface {
+	Track(event AnalyticsEvent)
+	Close()
+}
+
+type noopAnalytics struct{}
+
+func (noopAnalytics) Track(AnalyticsEvent) {}
+func (noopAnalytics) Close()               {}
+
+// analytics is disabled by default; main replaces it when ANALYTICS_PROVIDER is set.
+var analytics AnalyticsHook = noopAnalytics{}
+
+func track(name string, userID int64, properties map[string]string) {
+	analytics.Track(AnalyticsEvent{Name: name, DistinctID: idObfuscator.Obfuscate(userID), Properties: properties, Time: time.Now()})
+}
+
+// analyticsCategory is the category property of EventFactSaved. Keyboard categories
+// and questionnaire keys are passed through; anything the user typed is "custom".
+func analyticsCategory(key string) string {
+	for _, c := range categories {
+		if normalizeKey(c.Label) == key {
+			return key
+		}
+	}
+	for _, q := range questionnaires {
+		for _, question := range q.Questions {
+			if question.Key == key {
+				return key
+			}
+		}
+	}
+	return "custom"
+}
+
+// analyticsCommand is the command property of EventCommandUsed: built-in and
+// questionnaire commands by name, anything else the user typed as "other".
+func analyticsCommand(command string) string {
+	if _, ok := questionnaires[command]; ok || builtinCommands[command] {
+		return command
+	}
+	return "other"
+}
+
+// BatchExporter buffers events and POSTs them in batches to an HTTP analytics API.
+type BatchExporter struct {
+	Endpoint      string
+	Encode        func(events []AnalyticsEvent) ([]byte, error)
+	BatchSize     int
+	FlushInterval time.Duration
+	Client        *http.Client
+
+	events chan AnalyticsEvent
+	done   chan struct{}
+}
+
+func NewBatchExporter(endpoint string, encode func([]AnalyticsEvent) ([]byte, error), batchSize int, flushInterval time.Duration) *BatchExporter {
+	e := &BatchExporter{
+		Endpoint:      endpoint,
+		Encode:        encode,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+		events:        make(chan AnalyticsEvent, batchSize*10),
+		done:          make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Track enqueues an event, dropping it if the exporter has fallen too far behind.
+func (e *BatchExporter) Track(event AnalyticsEvent) {
+	select {
+	case e.events <- event:
+	default:
+		log.Printf("[WARN] Analytics queue full, dropping %s event", event.Name)
+	}
+}
+
+// Close flushes pending events and stops the exporter.
+func (e *BatchExporter) Close() {
+	close(e.events)
+	<-e.done
+}
+
+func (e *BatchExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]AnalyticsEvent, 0, e.BatchSize)
+	for {
+		select {
+		case event, ok := <-e.events:
+			if !ok {
+				e.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= e.BatchSize {
+				e.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (e *BatchExporter) flush(batch []AnalyticsEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := e.Encode(batch)
+	if err != nil {
+		log.Printf("[ERROR] Failed to encode %d analytics events: %v", len(batch), err)
+		return
+	}
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[ERROR] Failed to export %d analytics events: %v", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[ERROR] Analytics endpoint returned %s for %d events", resp.Status, len(batch))
+		return
+	}
+	log.Printf("[DEBUG] Exported %d analytics events", len(batch))
+}
+
+// posthogEncoder builds a PostHog /batch/ payload.
+func posthogEncoder(apiKey string) func([]AnalyticsEvent) ([]byte, error) {
+	return func(events []AnalyticsEvent) ([]byte, error) {
+		type posthogEvent struct {
+			Event      string            `json:"event"`
+			DistinctID string            `json:"distinct_id"`
+			Properties map[string]string `json:"properties,omitempty"`
+			Timestamp  string            `json:"timestamp"`
+		}
+		batch := make([]posthogEvent, 0, len(events))
+		for _, ev := range events {
+			batch = append(batch, posthogEvent{
+				Event:      ev.Name,
+				DistinctID: ev.DistinctID,
+				Properties: ev.Properties,
+				Timestamp:  ev.Time.UTC().Format(time.RFC3339),
+			})
+		}
+		return json.Marshal(struct {
+			APIKey string         `json:"api_key"`
+			Batch  []posthogEvent `json:"batch"`
+		}{apiKey, batch})
+	}
+}
+
+// amplitudeEncoder builds an Amplitude HTTP V2 / Batch API payload.
+func amplitudeEncoder(apiKey string) func([]AnalyticsEvent) ([]byte, error) {
+	return func(events []AnalyticsEvent) ([]byte, error) {
+		type amplitudeEvent struct {
+			EventType       string            `json:"event_type"`
+			UserID          string            `json:"user_id"`
+			EventProperties map[string]string `json:"event_properties,omitempty"`
+			Time            int64             `json:"time"`
+		}
+		batch := make([]amplitudeEvent, 0, len(events))
+		for _, ev := range events {
+			batch = append(batch, amplitudeEvent{
+				EventType:       ev.Name,
+				UserID:          ev.DistinctID,
+				EventProperties: ev.Properties,
+				Time:            ev.Time.UnixMilli(),
+			})
+		}
+		return json.Marshal(struct {
+			APIKey string           `json:"api_key"`
+			Events []amplitudeEvent `json:"events"`
+		}{apiKey, batch})
+	}
+}
+
+// newAnalyticsFromEnv configures an exporter from ANALYTICS_* variables, or returns nil when disabled.
+func newAnalyticsFromEnv() (AnalyticsHook, error) {
+	provider := strings.ToLower(os.Getenv("ANALYTICS_PROVIDER"))
+	if provider == "" {
+		return nil, nil
+	}
+	apiKey := os.Getenv("ANALYTICS_API_KEY")
+	if apiKey == "" {
+		return nil, errors.New("ANALYTICS_API_KEY is required when ANALYTICS_PROVIDER is set")
+	}
+
+	var endpoint string
+	var encode func([]AnalyticsEvent) ([]byte, error)
+	switch provider {
+	case "posthog":
+		endpoint, encode = "https://us.i.posthog.com/batch/", posthogEncoder(apiKey)
+	case "amplitude":
+		endpoint, encode = "https://api2.amplitude.com/batch", amplitudeEncoder(apiKey)
+	default:
+		return nil, fmt.Errorf("unknown ANALYTICS_PROVIDER %q (want posthog or amplitude)", provider)
+	}
+	if custom := os.Getenv("ANALYTICS_ENDPOINT"); custom != "" {
+		endpoint = custom
+	}
+
+	batchSize := 20
+	if raw := os.Getenv("ANALYTICS_BATCH_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid ANALYTICS_BATCH_SIZE %q", raw)
+		}
+		batchSize = n
+	}
+	flushInterval := 10 * time.Second
+	if raw := os.Getenv("ANALYTICS_FLUSH_INTERVAL"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid ANALYTICS_FLUSH_INTERVAL %q", raw)
+		}
+		flushInterval = d
+	}
+
+	log.Printf("[INFO] Analytics enabled: %s -> %s (batch %d, flush every %s)", provider, endpoint, batchSize, flushInterval)
+	return NewBatchExporter(endpoint, encode, batchSize, flushInterval), nil
+}
+
+// --- Aggregate Export ---
+
+// Aggregates are anonymized statistics over all sessions for the course team. They
+// never contain fact values, user IDs or names, and custom categories used by fewer
+// than aggregateMinUsers users are folded into "other" so a category name cannot
+// single anyone out.
+type Aggregates struct {
+	GeneratedAt string         `json:"generated_at"`
+	Sessions    int            `json:"sessions"`
+	Categories  map[string]int `json:"categories"`  // Users per category
+	FactLength  map[string]int `json:"fact_length"` // Facts per value length in characters
+	LastActive  map[string]int `json:"last_active"` // Sessions per time since their last update
+	ActiveHours [24]int        `json:"active_hours_utc"`
+}
+
+// aggregateMinUsers is overridden by AGGREGATES_MIN_USERS.
+var aggregateMinUsers = 5
+
+// computeAggregates summarises sessions at now. Call it from the update loop: handlers
+// write session maps without taking the storage lock.
+func computeAggregates(sessions map[int64]*UserSession, now time.Time) Aggregates {
+	agg := Aggregates{
+		GeneratedAt: now.UTC().Format(time.RFC3339),
+		Sessions:    len(sessions),
+		Categories:  make(map[string]int),
+		FactLength:  make(map[string]int),
+		LastActive:  make(map[string]int),
+	}
+	for _, session := range sessions {
+		for key, value := range session.UserData {
+			agg.Categories[key]++
+			switch n := utf8.RuneCountInString(value); {
+			case n <= 10:
+				agg.FactLength["1-10"]++
+			case n <= 50:
+				agg.FactLength["11-50"]++
+			case n <= 200:
+				agg.FactLength["51-200"]++
+			default:
+				agg.FactLength["201+"]++
+			}
+		}
+
+		if session.LastUpdated == 0 {
+			agg.LastActive["never"]++
+			continue
+		}
+		last := time.Unix(session.LastUpdated, 0)
+		switch age := now.Sub(last); {
+		case age < 24*time.Hour:
+			agg.LastActive["<1d"]++
+		case age < 7*24*time.Hour:
+			agg.LastActive["1-7d"]++
+		case age < 30*24*time.Hour:
+			agg.LastActive["7-30d"]++
+		default:
+			agg.LastActive["30d+"]++
+		}
+		agg.ActiveHours[last.UTC().Hour()]++
+	}
+
+	predefined := make(map[string]bool, len(categories))
+	for _, c := range categories {
+		predefined[normalizeKey(c.Label)] = true
+	}
+	other := 0
+	for key, users := range agg.Categories {
+		if !predefined[key] && users < aggregateMinUsers {
+			other += users
+			delete(agg.Categories, key)
+		}
+	}
+	if other > 0 {
+		agg.Categories["other"] += other
+	}
+	return agg
+}
+
+// exportAggregates writes agg to sink: an http(s) URL receives a JSON POST, anything
+// else is a file path that is replaced atomically. It touches no session data, so it
+// can run off the update loop; the snapshot itself must be taken on the loop.
+func exportAggregates(agg Aggregates, sink string, client *http.Client) error {
+	data, err := json.MarshalIndent(agg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(sink, "http://") && !strings.HasPrefix(sink, "https://") {
+		return writeFileAtomic(sink, data)
+	}
+	resp, err := client.Post(sink, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sink returned %s", resp.Status)
+	}
+	return nil
+}
+
+// aggregateExporter sends snapshots taken by the update loop to AGGREGATES_SINK.
+type aggregateExporter struct {
+	sink   string
+	client *http.Client
+}
+
+// Export writes agg in the background so a slow sink never stalls the update loop.
+func (e *aggregateExporter) Export(agg Aggregates) {
+	go func() {
+		if err := exportAggregates(agg, e.sink, e.client); err != nil {
+			log.Printf("[ERROR] Failed to export aggregates to %s: %v", e.sink, err)
+			return
+		}
+		log.Printf("[INFO] Exported aggregate statistics to %s", e.sink)
+	}()
+}
+
+// --- Log Levels ---
+
+// Log levels, matched against the [LEVEL] tag at the start of each log message.
+const (
+	LevelDebug int32 = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = map[string]int32{"debug": LevelDebug, "info": LevelInfo, "warn": LevelWarn, "error": LevelError}
+
+// parseLogLevel accepts debug, info, warn or error in any case.
+func parseLogLevel(name string) (int32, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", name)
+	}
+	return level, nil
+}
+
+// levelFilter drops log lines below its minimum level. It is installed as the
+// output of the standard logger, which calls Write once per line, so the level
+// can be changed at runtime with /admin loglevel.
+type levelFilter struct {
+	out io.Writer
+	min atomic.Int32
+}
+
+// logLevel is the filter installed by main; LOG_LEVEL sets its initial level.
+var logLevel = &levelFilter{out: os.Stderr}
+
+func (f *levelFilter) Write(p []byte) (int, error) {
+	if lineLevel(p) < f.min.Load() {
+		return len(p), nil
+	}
+	return f.out.Write(p)
+}
+
+// lineLevel reads the [LEVEL] tag after the timestamp. Other tags such as [UPDATE]
+// count as info. Untagged lines are never filtered: they are log.Fatal startup errors
+// and messages from the Telegram library, which must not vanish at LOG_LEVEL=error.
+func lineLevel(line []byte) int32 {
+	start := bytes.IndexByte(line, '[')
+	if start < 0 || strings.TrimLeft(string(line[:start]), "0123456789/:. ") != "" {
+		return LevelError
+	}
+	end := bytes.IndexByte(line[start:], ']')
+	if end < 0 {
+		return LevelInfo
+	}
+	switch string(line[start+1 : start+end]) {
+	case "DEBUG":
+		return LevelDebug
+	case "WARN":
+		return LevelWarn
+	case "ERROR":
+		return LevelError
+	}
+	return LevelInfo
+}
+
+// telegramDebug switches the Telegram API request log on and off (TELEGRAM_DEBUG,
+// /admin debug). The library's bot.Debug is a plain field read by the polling
+// goroutine, so it is never set; debugClient does the logging instead.
+var telegramDebug atomic.Bool
+
+// debugClient is the bot's HTTP client. It logs each API call and its response while
+// telegramDebug is set. The URL holds the bot token, so only the method name is logged.
+type debugClient struct {
+	client *http.Client
+}
+
+func (c debugClient) Do(req *http.Request) (*http.Response, error) {
+	if !telegramDebug.Load() {
+		return c.client.Do(req)
+	}
+	method := path.Base(req.URL.Path)
+	var params []byte
+	if req.Body != nil && req.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		var err error
+		if params, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(params))
+	}
+	log.Printf("[DEBUG] Telegram API %s, params: %s", method, params)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		log.Printf("[DEBUG] Telegram API %s failed: %v", method, redactToken(err))
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	log.Printf("[DEBUG] Telegram API %s, response: %s", method, body)
+	return resp, nil
+}
+
+// botTokenInURL matches the /bot<token>/ segment of a Bot API request URL.
+var botTokenInURL = regexp.MustCompile(`/bot[^/]*/`)
+
+// redactToken hides the bot token in the request URL that net/http puts into its
+// *url.Error messages. Other errors are returned unchanged.
+func redactToken(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	return &url.Error{Op: urlErr.Op, URL: botTokenInURL.ReplaceAllString(urlErr.URL, "/bot<redacted>/"), Err: urlErr.Err}
+}
+
+// --- Handler Latency ---
+
+// handlerBudget is how long a handler may run before it is reported as slow.
+// Overridden by HANDLER_BUDGET (a Go duration, e.g. "250ms").
+var handlerBudget = 500 * time.Millisecond
+
+// Handler metrics, published by expvar under /debug/vars when METRICS_ADDR is set.
+var (
+	handlerCalls      = expvar.NewMap("handler_calls_total")
+	handlerDurationMs = expvar.NewMap("handler_duration_ms_total")
+	handlerSlow       = expvar.NewMap("handler_slow_total")
+)
+
+type handlerFunc func(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI)
+
+// faults are failure injection points for resilience tests. Only _test.go files set
+// them, and they are consulted only when faultsEnabled, so a hook assigned by mistake
+// in the bot itself never runs.
+var faults struct {
+	// StorageWrite runs before each storage file write; an error aborts the write.
+	StorageWrite func(path string) error
+	// Send runs before each Telegram call; an error (e.g. a *tgbotapi.Error with code
+	// 429 or 500) is returned instead of making the call.
+	Send func(c tgbotapi.Chattable) error
+	// Handler runs before each handler, e.g. to sleep and simulate a slow handler.
+	Handler func(name string)
+}
+
+// faultsEnabled reports whether the faults hooks may run: testing.Testing is true in
+// test binaries only.
+func faultsEnabled() bool { return testing.Testing() }
+
+// runHandler executes a handler and records how long it took and which state transition it made.
+func runHandler(name string, handler handlerFunc, update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	start, from := time.Now(), session.State
+	if faultsEnabled() && faults.Handler != nil {
+		faults.Handler(name)
+	}
+	handler(update, session, bot)
+	observeHandler(name, time.Since(start), update)
+	observeTransition(name, from, session.State)
+}
+
+// buildVersion is stamped into conversation events so dashboards can line them up
+// with deploys. Set it with -ldflags "-X main.buildVersion=...".
+var buildVersion = "dev"
+
+// stateTransitions counts handler runs by from, to, handler and outcome; outcome is
+// "moved" when the state changed and "stayed" when the handler kept it (re-prompts,
+// validation errors).
+var stateTransitions = expvar.NewMap("state_transitions_total")
+
+// observeTransition records the transition a handler made.
+func observeTransition(handler string, from, to int) {
+	outcome := "stayed"
+	if to != from {
+		outcome = "moved"
+	}
+	stateTransitions.Add(fmt.Sprintf("from=%s,to=%s,handler=%s,outcome=%s", stateName(from), stateName(to), handler, outcome), 1)
+}
+
+// startConversation marks the beginning of flow. Flows that interrupt another one call
+// it after UserSession.Suspend, which saved the interrupted flow's name and start.
+func startConversation(session *UserSession, flow string, now time.Time) {
+	session.ConversationFlow = flow
+	session.ConversationStarted = now.Unix()
+}
+
+// endConversation emits EventConversation for the active conversation with result
+// ("completed" or "cancelled") and clears it. It does nothing when none is running.
+func endConversation(session *UserSession, result string, userID int64, now time.Time) {
+	if session.ConversationFlow == "" {
+		return
+	}
+	var duration time.Duration
+	if session.ConversationStarted > 0 {
+		duration = now.Sub(time.Unix(session.ConversationStarted, 0))
+	}
+	log.Printf("[INFO] Conversation ended: flow=%s result=%s duration=%s user_id=%d version=%s",
+		session.ConversationFlow, result, duration, userID, buildVersion)
+	track(EventConversation, userID, map[string]string{
+		"flow":        session.ConversationFlow,
+		"result":      result,
+		"duration_ms": strconv.FormatInt(duration.Milliseconds(), 10),
+		"version":     buildVersion,
+	})
+	session.ConversationFlow = ""
+	session.ConversationStarted = 0
+}
+
+func observeHandler(name string, elapsed time.Duration, update *tgbotapi.Update) {
+	handlerCalls.Add(name, 1)
+	handlerDurationMs.Add(name, elapsed.Milliseconds())
+	if elapsed > handlerBudget {
+		handlerSlow.Add(name, 1)
+		log.Printf("[WARN] Slow handler: handler=%s duration=%s budget=%s update_id=%d user_id=%d", name, elapsed, handlerBudget, update.UpdateID, update.Message.From.ID)
+	}
+}
+
+// --- Send Errors ---
+
+// SendErrorKind tells the caller what to do about a failed send.
+type SendErrorKind int
+
+const (
+	// SendTransient failures (network, 429, 5xx) may succeed if retried later.
+	SendTransient SendErrorKind = iota
+	// SendPermanent failures (bad request, chat not found) will fail again as-is.
+	SendPermanent
+	// SendBlocked means the user blocked the bot or deleted their account (403).
+	SendBlocked
+)
+
+func (k SendErrorKind) String() string {
+	switch k {
+	case SendTransient:
+		return "transient"
+	case SendPermanent:
+		return "permanent"
+	case SendBlocked:
+		return "blocked"
+	}
+	return "unknown"
+}
+
+// SendError wraps a failed Telegram send with its classification.
+type SendError struct {
+	Kind   SendErrorKind
+	ChatID int64
+	Err    error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("send to chat %d failed (%s): %v", e.ChatID, e.Kind, e.Err)
+}
+
+func (e *SendError) Unwrap() error { return e.Err }
+
+// errRecipientBlocked is returned without calling Telegram when the session is already flagged as blocked.
+var errRecipientBlocked = errors.New("recipient has blocked the bot")
+
+var sendErrors = expvar.NewMap("send_errors_total")
+
+// classifySendError maps a Bot API error onto a SendErrorKind. Network errors carry
+// the request URL, so the token is redacted before the error is wrapped.
+func classifySendError(chatID int64, err error) *SendError {
+	kind := SendTransient
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusForbidden:
+			kind = SendBlocked
+		case apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500:
+			kind = SendTransient
+		case apiErr.Code >= 400:
+			kind = SendPermanent
+		}
+	}
+	return &SendError{Kind: kind, ChatID: chatID, Err: redactToken(err)}
+}
+
+// send delivers a message and applies the error policy: sessions whose user blocked
+// the bot are flagged and skipped from then on. session may be nil for chats
+// without one (e.g. the admin chat).
+func send(bot *tgbotapi.BotAPI, session *UserSession, c tgbotapi.Chattable) error {
+	if session != nil && session.Blocked {
+		return errRecipientBlocked
+	}
+
+	var err error
+	if faultsEnabled() && faults.Send != nil {
+		err = faults.Send(c)
+	}
+	if err == nil {
+		_, err = bot.Send(c)
+	}
+	if err == nil {
+		return nil
+	}
+
+	sendErr := classifySendError(chatIDOf(c), err)
+	sendErrors.Add(sendErr.Kind.String(), 1)
+	log.Printf("[ERROR] %v", sendErr)
+
+	if sendErr.Kind == SendBlocked && session != nil {
+		session.Blocked = true
+		log.Printf("[INFO] Chat %d blocked the bot, no longer sending to it", sendErr.ChatID)
+	}
+	return sendErr
+}
+
+// chatIDOf extracts the target chat from the configs this bot sends.
+func chatIDOf(c tgbotapi.Chattable) int64 {
+	switch cfg := c.(type) {
+	case tgbotapi.MessageConfig:
+		return cfg.ChatID
+	case tgbotapi.PhotoConfig:
+		return cfg.ChatID
+	}
+	return 0
+}
+
+// --- Questionnaire Scripts ---
+
+// builtinCommands cannot be taken over by a questionnaire script.
+var builtinCommands = map[string]bool{
+	"start": true, "show_data": true, "card": true, "feedback": true,
+	"ticket": true, "cancel": true, "admin": true, "batch": true, "tutorial": true,
+}
+
+// Questionnaire is a data-collection flow defined in a JSON script and started
+// with /<Command>. Questions are asked in order unless a Branch jumps elsewhere.
+// Each answer is stored as a fact under the question's Key.
+type Questionnaire struct {
+	Command   string     `json:"command"`
+	Intro     string     `json:"intro,omitempty"`
+	Outro     string     `json:"outro,omitempty"`
+	Questions []Question `json:"questions"`
+
+	index map[string]int // Question ID -> position
+}
+
+// Question is one step of a Questionnaire.
+type Question struct {
+	ID       string `json:"id,omitempty"` // Branch target name, defaults to Key
+	Key      string `json:"key"`
+	Prompt   string `json:"prompt"`
+	Validate string `json:"validate,omitempty"` // Optional regexp the whole answer must match
+	Error    string `json:"error,omitempty"`    // Shown when Validate fails
+	// Placeholder is shown in the input box while the question waits for an answer.
+	Placeholder string   `json:"placeholder,omitempty"`
+	Next        []Branch `json:"next,omitempty"` // Evaluated in order after answering; falls through to the next question
+
+	pattern *regexp.Regexp
+}
+
+// questionEnd is the branch target that finishes the questionnaire.
+const questionEnd = "end"
+
+// Branch jumps to Goto when If holds (or unconditionally when If is nil).
+type Branch struct {
+	If   *Condition `json:"if,omitempty"`
+	Goto string     `json:"goto"`
+}
+
+// Condition compares a stored fact against a value.
+// Ops: eq, ne, lt, le, gt, ge (numeric), set, unset.
+type Condition struct {
+	Key   string `json:"key"`
+	Op    string `json:"op"`
+	Value string `json:"value,omitempty"`
+}
+
+var conditionOps = map[string]bool{"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true, "set": true, "unset": true}
+
+// Holds reports whether the condition is true for the given facts.
+// Numeric comparisons are false when either side is not a number.
+func (c *Condition) Holds(userData map[string]string) bool {
+	actual, ok := userData[c.Key]
+	switch c.Op {
+	case "set":
+		return ok
+	case "unset":
+		return !ok
+	case "eq":
+		return ok && strings.EqualFold(actual, c.Value)
+	case "ne":
+		return !ok || !strings.EqualFold(actual, c.Value)
+	}
+
+	a, errA := strconv.ParseFloat(strings.TrimSpace(actual), 64)
+	b, errB := strconv.ParseFloat(c.Value, 64)
+	if !ok || errA != nil || errB != nil {
+		return false
+	}
+	switch c.Op {
+	case "lt":
+		return a < b
+	case "le":
+		return a <= b
+	case "gt":
+		return a > b
+	case "ge":
+		return a >= b
+	}
+	return false
+}
+
+// nextQuestion picks the index to ask after question i, or len(q.Questions) when finished.
+func (q *Questionnaire) nextQuestion(i int, userData map[string]string) int {
+	for _, branch := range q.Questions[i].Next {
+		if branch.If == nil || branch.If.Holds(userData) {
+			return q.target(branch.Goto)
+		}
+	}
+	return i + 1
+}
+
+func (q *Questionnaire) target(id string) int {
+	if id == questionEnd {
+		return len(q.Questions)
+	}
+	return q.index[id]
+}
+
+// successors lists every question index reachable in one step from question i.
+func (q *Questionnaire) successors(i int) []int {
+	var next []int
+	for _, branch := range q.Questions[i].Next {
+		next = append(next, q.target(branch.Goto))
+		if branch.If == nil {
+			return next // Later branches and the fall-through are unreachable
+		}
+	}
+	return append(next, i+1)
+}
+
+// validateBranches checks branch targets exist, the flow cannot loop and every question is reachable.
+func (q *Questionnaire) validateBranches() error {
+	for _, question := range q.Questions {
+		for _, branch := range question.Next {
+			if branch.Goto != questionEnd {
+				if _, ok := q.index[branch.Goto]; !ok {
+					return fmt.Errorf("question %q branches to unknown question %q", question.ID, branch.Goto)
+				}
+			}
+			if branch.If != nil {
+				if branch.If.Key == "" || !conditionOps[branch.If.Op] {
+					return fmt.Errorf("question %q has an invalid condition (key %q, op %q)", question.ID, branch.If.Key, branch.If.Op)
+				}
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, len(q.Questions))
+	var visit func(i int) error
+	visit = func(i int) error {
+		if i >= len(q.Questions) {
+			return nil
+		}
+		switch marks[i] {
+		case visiting:
+			return fmt.Errorf("question %q is part of a loop", q.Questions[i].ID)
+		case visited:
+			return nil
+		}
+		marks[i] = visiting
+		for _, next := range q.successors(i) {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+		marks[i] = visited
+		return nil
+	}
+	if err := visit(0); err != nil {
+		return err
+	}
+	for i, mark := range marks {
+		if mark == unvisited {
+			return fmt.Errorf("question %q can never be reached", q.Questions[i].ID)
+		}
+	}
+	return nil
+}
+
+// questionnaires holds the loaded scripts keyed by command. Empty unless SCRIPTS_FILE is set.
+var questionnaires = map[string]*Questionnaire{}
+
+// LoadQuestionnaires reads a script file of the form {"questionnaires": [...]}.
+func LoadQuestionnaires(path string) (map[string]*Questionnaire, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read scripts: %w", err)
+	}
+	return ParseQuestionnaires(data)
+}
+
+// ParseQuestionnaires decodes and validates questionnaire scripts.
+func ParseQuestionnaires(data []byte) (map[string]*Questionnaire, error) {
+	var file struct {
+		Questionnaires []*Questionnaire `json:"questionnaires"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse scripts: %w", err)
+	}
+
+	result := make(map[string]*Questionnaire, len(file.Questionnaires))
+	for i, q := range file.Questionnaires {
+		if q.Command == "" {
+			return nil, fmt.Errorf("questionnaire #%d: command is required", i+1)
+		}
+		if builtinCommands[q.Command] {
+			return nil, fmt.Errorf("questionnaire /%s: command clashes with a built-in command", q.Command)
+		}
+		if _, dup := result[q.Command]; dup {
+			return nil, fmt.Errorf("questionnaire /%s: defined twice", q.Command)
+		}
+		if len(q.Questions) == 0 {
+			return nil, fmt.Errorf("questionnaire /%s: no questions", q.Command)
+		}
+		q.index = make(map[string]int, len(q.Questions))
+		for j := range q.Questions {
+			question := &q.Questions[j]
+			if question.Key == "" || question.Prompt == "" {
+				return nil, fmt.Errorf("questionnaire /%s question #%d: key and prompt are required", q.Command, j+1)
+			}
+			question.Key = normalizeKey(question.Key)
+			for _, branch := range question.Next {
+				if branch.If != nil {
+					branch.If.Key = normalizeKey(branch.If.Key)
+				}
+			}
+			if question.ID == "" {
+				question.ID = question.Key
+			}
+			if _, dup := q.index[question.ID]; dup || question.ID == questionEnd {
+				return nil, fmt.Errorf("questionnaire /%s question #%d: id %q is reserved or used twice", q.Command, j+1, question.ID)
+			}
+			q.index[question.ID] = j
+			if question.Validate != "" {
+				pattern, err := regexp.Compile("^(?:" + question.Validate + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("questionnaire /%s question %q: invalid validate pattern: %w", q.Command, question.Key, err)
+				}
+				question.pattern = pattern
+			}
+		}
+		if err := q.validateBranches(); err != nil {
+			return nil, fmt.Errorf("questionnaire /%s: %w", q.Command, err)
+		}
+		result[q.Command] = q
+	}
+	return result, nil
+}
+
+// --- Cooldowns & Duplicate Suppression ---
+
+// commandCooldowns limits how often each user may run a command.
+var commandCooldowns = map[string]time.Duration{
+	"show_data": 5 * time.Second,
+	"card":      30 * time.Second,
+	"ticket":    5 * time.Second,
+}
+
+// duplicateWindow is how soon an identical message counts as an accidental double tap.
+const duplicateWindow = 2 * time.Second
+
+type lastMessage struct {
+	Text string
+	At   time.Time
+}
+
+// RateGuard tracks recent activity per user in memory to drop repeated commands and double taps.
+// Entries older than every cooldown are swept out at most once per guardSweepInterval.
+type RateGuard struct {
+	mu           sync.Mutex
+	now          func() time.Time
+	lastCommands map[int64]map[string]time.Time
+	lastMessages map[int64]lastMessage
+	lastSweep    time.Time
+}
+
+// guardSweepInterval is how often Check drops expired entries.
+const guardSweepInterval = time.Minute
+
+func NewRateGuard() *RateGuard {
+	return &RateGuard{
+		now:          time.Now,
+		lastCommands: make(map[int64]map[string]time.Time),
+		lastMessages: make(map[int64]lastMessage),
+	}
+}
+
+// Check records the update and returns a non-empty reason if it should be suppressed.
+func (g *RateGuard) Check(update tgbotapi.Update) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	userID, text, now := update.Message.From.ID, update.Message.Text, g.now()
+	if now.Sub(g.lastSweep) >= guardSweepInterval {
+		g.sweep(now)
+	}
+
+	previous, seen := g.lastMessages[userID]
+	g.lastMessages[userID] = lastMessage{Text: text, At: now}
+	if seen && previous.Text == text && now.Sub(previous.At) < duplicateWindow {
+		return "duplicate message"
+	}
+
+	if update.Message.IsCommand() {
+		command := update.Message.Command()
+		if cooldown, limited := commandCooldowns[command]; limited {
+			if g.lastCommands[userID] == nil {
+				g.lastCommands[userID] = make(map[string]time.Time)
+			}
+			if last, ok := g.lastCommands[userID][command]; ok && now.Sub(last) < cooldown {
+				return fmt.Sprintf("/%s cooldown (%s)", command, cooldown)
+			}
+			g.lastCommands[userID][command] = now
+		}
+	}
+	return ""
+}
+
+// sweep forgets users whose last message and commands are past every cooldown, so
+// the maps hold only recently active users. Callers hold g.mu.
+func (g *RateGuard) sweep(now time.Time) {
+	longest := duplicateWindow
+	for _, cooldown := range commandCooldowns {
+		if cooldown > longest {
+			longest = cooldown
+		}
+	}
+	for userID, last := range g.lastMessages {
+		if now.Sub(last.At) >= longest {
+			delete(g.lastMessages, userID)
+		}
+	}
+	for userID, commands := range g.lastCommands {
+		for command, at := range commands {
+			if now.Sub(at) >= longest {
+				delete(commands, command)
+			}
+		}
+		if len(commands) == 0 {
+			delete(g.lastCommands, userID)
+		}
+	}
+	g.lastSweep = now
+}
+
+// guard is shared by the update loop; its state is deliberately not persisted.
+var guard = NewRateGuard()
+
+// --- Read-Only Mode ---
+
+// readOnlyCommands are answered from existing data and remain available while storage is read-only.
+var readOnlyCommands = map[string]bool{"show_data": true, "card": true, "ticket": true}
+
+const readOnlyReply = "I'm being updated right now and can't save anything. Please try again shortly."
+
+// mutatesSession reports whether handling the update could change stored data.
+func mutatesSession(update tgbotapi.Update) bool {
+	return !(update.Message.IsCommand() && readOnlyCommands[update.Message.Command()])
+}
+
+// --- Keyboards ---
+
+// Category is a predefined category offered on the main keyboard.
+type Category struct {
+	Label       string // Button text; the fact key is its normalized form
+	Placeholder string // Input field hint while the user types the value
+}
+
+// categories are the predefined categories, laid out two per keyboard row.
+var categories = []Category{
+	{Label: "Age", Placeholder: "Type your age…"},
+	{Label: "Favourite colour", Placeholder: "Type a colour…"},
+	{Label: "Number of siblings", Placeholder: "Type a number…"},
+}
+
+// Button labels and input hints that are not tied to a category.
+const (
+	customChoiceLabel       = "Something else..."
+	menuPlaceholder         = "Choose a category…"
+	customChoicePlaceholder = "Type a category name…"
+	feedbackPlaceholder     = "Type your message to the team…"
+	batchPlaceholder        = "age: 30"
+)
+
+var mainKeyboard = buildMainKeyboard()
+
+func buildMainKeyboard() tgbotapi.ReplyKeyboardMarkup {
+	buttons := make([]tgbotapi.KeyboardButton, 0, len(categories)+1)
+	for _, c := range categories {
+		buttons = append(buttons, tgbotapi.NewKeyboardButton(c.Label))
+	}
+	buttons = append(buttons, tgbotapi.NewKeyboardButton(customChoiceLabel))
+
+	var rows [][]tgbotapi.KeyboardButton
+	for len(buttons) > 2 {
+		rows = append(rows, buttons[:2])
+		buttons = buttons[2:]
+	}
+	rows = append(rows, buttons, tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("Done")))
+
+	keyboard := tgbotapi.NewReplyKeyboard(rows...)
+	keyboard.InputFieldPlaceholder = menuPlaceholder
+	return keyboard
+}
+
+// categoryByLabel returns the predefined category whose button says label, or nil.
+func categoryByLabel(label string) *Category {
+	for i := range categories {
+		if categories[i].Label == label {
+			return &categories[i]
+		}
+	}
+	return nil
+}
+
+// valuePlaceholder is the input hint while the user types the value for key.
+func valuePlaceholder(key string) string {
+	for _, c := range categories {
+		if normalizeKey(c.Label) == key {
+			return c.Placeholder
+		}
+	}
+	return fmt.Sprintf("Type your %s…", key)
+}
+
+// inputHint asks Telegram to open the reply box with placeholder in the input field.
+// Telegram rejects placeholders longer than 64 characters, so longer ones are cut.
+func inputHint(placeholder string) tgbotapi.ForceReply {
+	if runes := []rune(placeholder); len(runes) > 64 {
+		placeholder = string(runes[:63]) + "…"
+	}
+	return tgbotapi.ForceReply{ForceReply: true, Selective: true, InputFieldPlaceholder: placeholder}
+}
+
+// --- Quotas ---
+
+// Quotas bound how much a single user can store. Zero disables a limit.
+type Quotas struct {
+	MaxCategories   int // Distinct facts per user
+	MaxValueRunes   int // Characters per fact value
+	MaxSessionBytes int // Serialized size of all the user's facts; tickets have their own limits
+	MaxOpenTickets  int // Tickets a user may have open at once
+	MaxTicketRunes  int // Characters per /feedback message
+}
+
+// quotas can be overridden with QUOTA_MAX_CATEGORIES, QUOTA_MAX_VALUE_LENGTH,
+// QUOTA_MAX_SESSION_BYTES, QUOTA_MAX_OPEN_TICKETS and QUOTA_MAX_TICKET_LENGTH.
+var quotas = Quotas{MaxCategories: 50, MaxValueRunes: 500, MaxSessionBytes: 64 * 1024, MaxOpenTickets: 10, MaxTicketRunes: 4000}
+
+// QuotaError is returned when a write would exceed a quota. Message is safe to show the user.
+type QuotaError struct {
+	Message string
+}
+
+func (e *QuotaError) Error() string { return "quota exceeded: " + e.Message }
+
+// setFact stores a fact after checking quotas, leaving the session untouched on error.
+func setFact(session *UserSession, key, value string, updateID int) error {
+	if quotas.MaxValueRunes > 0 && utf8.RuneCountInString(value) > quotas.MaxValueRunes {
+		return &QuotaError{fmt.Sprintf("That's a bit long for me to remember. Please keep it under %d characters.", quotas.MaxValueRunes)}
+	}
+	previous, existed := session.UserData[key]
+	if !existed && quotas.MaxCategories > 0 && len(session.UserData) >= quotas.MaxCategories {
+		return &QuotaError{fmt.Sprintf("I can only remember %d different things about you. Send /cancel and change one of them instead of adding a new one.", quotas.MaxCategories)}
+	}
+
+	session.UserData[key] = value
+	if quotas.MaxSessionBytes > 0 {
+		if data, err := json.Marshal(session.UserData); err == nil && len(data) > quotas.MaxSessionBytes {
+			if existed {
+				session.UserData[key] = previous
+			} else {
+				delete(session.UserData, key)
+			}
+			return &QuotaError{"My notes about you are full. Try shortening some of the things you already told me."}
+		}
+	}
+
+	if session.FactUpdateIDs == nil {
+		session.FactUpdateIDs = make(map[string]int)
+	}
+	session.FactUpdateIDs[key] = updateID
+	return nil
+}
+
+// checkTicketQuota reports whether the user may open another ticket; text is the
+// message, or "" before it has been typed.
+func checkTicketQuota(session *UserSession, text string) error {
+	if quotas.MaxOpenTickets > 0 {
+		open := 0
+		for _, ticket := range session.Tickets {
+			if ticket.Status != TicketClosed {
+				open++
+			}
+		}
+		if open >= quotas.MaxOpenTickets {
+			return &QuotaError{fmt.Sprintf("You already have %d open tickets. Please wait for the team to answer them; check on them with /ticket.", open)}
+		}
+	}
+	if quotas.MaxTicketRunes > 0 && utf8.RuneCountInString(text) > quotas.MaxTicketRunes {
+		return &QuotaError{fmt.Sprintf("That message is too long for a ticket. Please keep it under %d characters, or /cancel.", quotas.MaxTicketRunes)}
+	}
+	return nil
+}
+
+// loadQuotasFromEnv applies QUOTA_* overrides.
+func loadQuotasFromEnv() error {
+	for env, target := range map[string]*int{
+		"QUOTA_MAX_CATEGORIES":    &quotas.MaxCategories,
+		"QUOTA_MAX_VALUE_LENGTH":  &quotas.MaxValueRunes,
+		"QUOTA_MAX_SESSION_BYTES": &quotas.MaxSessionBytes,
+		"QUOTA_MAX_OPEN_TICKETS":  &quotas.MaxOpenTickets,
+		"QUOTA_MAX_TICKET_LENGTH": &quotas.MaxTicketRunes,
+	} {
+		if raw := os.Getenv(env); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%s must be a non-negative integer, got %q", env, raw)
+			}
+			*target = n
+		}
+	}
+	return nil
+}
+
+// --- Helper Functions ---
+
+// stripEmojiFromKeys removes emoji from category names during normalisation. Set by KEY_STRIP_EMOJI.
+var stripEmojiFromKeys bool
+
+// normalizeKey canonicalises a category name before it is stored or looked up:
+// NFC, invisible format characters removed, optional emoji stripping,
+// lowercase, whitespace collapsed and trimmed.
+func normalizeKey(raw string) string {
+	var b strings.Builder
+	for _, r := range norm.NFC.String(raw) {
+		if isEmojiRune(r) {
+			if stripEmojiFromKeys {
+				continue
+			}
+		} else if unicode.Is(unicode.Cf, r) {
+			continue // Zero-width spaces, BOMs, direction marks, ...
+		}
+		b.WriteRune(r)
+	}
+	return strings.Join(strings.Fields(strings.ToLower(b.String())), " ")
+}
+
+// isEmojiRune reports whether r is a pictograph or one of the joiners/modifiers emoji sequences are built from.
+func isEmojiRune(r rune) bool {
+	switch {
+	case r == 0x200D, r == 0x20E3: // Zero-width joiner, keycap
+		return true
+	case r >= 0xFE00 && r <= 0xFE0F: // Variation selectors
+		return true
+	case r >= 0x1F3FB && r <= 0x1F3FF: // Skin tone modifiers
+		return true
+	case r >= 0xE0020 && r <= 0xE007F: // Tag sequences (subdivision flags)
+		return true
+	}
+	return unicode.Is(unicode.So, r)
+}
+
+// normalizeSessionFacts re-keys facts stored before key normalisation existed, merging
+// duplicates, and passes every value through the current value pipeline. When two raw
+// keys collide, the most recently written fact wins.
+func normalizeSessionFacts(session *UserSession) {
+	keys := make([]string, 0, len(session.UserData))
+	for k := range session.UserData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	normalized := make(map[string]string, len(session.UserData))
+	updateIDs := make(map[string]int, len(session.FactUpdateIDs))
+	for _, k := range keys {
+		nk := normalizeKey(k)
+		if nk == "" {
+			nk = k // Nothing left after normalisation; keep rather than lose the fact
+		}
+		if _, exists := normalized[nk]; exists && session.FactUpdateIDs[k] < updateIDs[nk] {
+			continue
+		}
+		normalized[nk] = normalizeValue(nk, session.UserData[k])
+		if id, ok := session.FactUpdateIDs[k]; ok {
+			updateIDs[nk] = id
+		}
+	}
+	session.UserData = normalized
+	if session.FactUpdateIDs != nil {
+		session.FactUpdateIDs = updateIDs
+	}
+}
+
+// valueSteps are the value normalization steps VALUE_NORMALIZE can list.
+var valueSteps = map[string]func(string) string{
+	"nfc":      norm.NFC.String,
+	"trim":     strings.TrimSpace,
+	"collapse": func(v string) string { return strings.Join(strings.Fields(v), " ") },
+	"lower":    strings.ToLower,
+}
+
+// valuePipeline is applied in order to every stored value. Overridden by VALUE_NORMALIZE.
+var valuePipeline = []string{"nfc", "trim", "collapse"}
+
+// lowercaseCategories are additionally lowercased after the pipeline; "*" means all.
+// Set by VALUE_LOWERCASE. Names and codes keep their case unless listed here.
+var lowercaseCategories = map[string]bool{}
+
+// normalizeValue prepares a value typed for category key before it is stored.
+func normalizeValue(key, value string) string {
+	for _, step := range valuePipeline {
+		value = valueSteps[step](value)
+	}
+	if lowercaseCategories["*"] || lowercaseCategories[key] {
+		value = strings.ToLower(value)
+	}
+	return value
+}
+
+// loadValueNormalizationFromEnv applies VALUE_NORMALIZE (comma-separated steps, "none"
+// for raw values) and VALUE_LOWERCASE (comma-separated categories, or "*").
+func loadValueNormalizationFromEnv() error {
+	if raw, ok := os.LookupEnv("VALUE_NORMALIZE"); ok {
+		pipeline := []string{}
+		for _, step := range strings.Split(raw, ",") {
+			step = strings.ToLower(strings.TrimSpace(step))
+			if step == "" || step == "none" {
+				continue
+			}
+			if _, known := valueSteps[step]; !known {
+				return fmt.Errorf("VALUE_NORMALIZE: unknown step %q (want nfc, trim, collapse, lower or none)", step)
+			}
+			pipeline = append(pipeline, step)
+		}
+		valuePipeline = pipeline
+	}
+	if raw := os.Getenv("VALUE_LOWERCASE"); raw != "" {
+		for _, category := range strings.Split(raw, ",") {
+			if category = strings.TrimSpace(category); category == "*" {
+				lowercaseCategories["*"] = true
+			} else if key := normalizeKey(category); key != "" {
+				lowercaseCategories[key] = true
+			}
+		}
+	}
+	return nil
+}
+
+func factsToString(userData map[string]string) string {
+	var facts []string
+	for k, v := range userData {
+		facts = append(facts, fmt.Sprintf("%s - %s", k, v))
+	}
+	return strings.Join(facts, "\n")
+}
+
+// --- Profile Card ---
+
+const (
+	cardWidth      = 480
+	cardPadding    = 24
+	cardLineHeight = 20
+	cardHeaderSize = 56
+	cardFontSize   = 13
+)
+
+// cardFont is Go Mono, which covers Latin, Cyrillic and Greek. A fixed-width font keeps
+// wrapLines' rune counting accurate.
+var cardFont = func() *opentype.Font {
+	f, err := opentype.Parse(gomono.TTF)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}()
+
+var (
+	cardBackground = color.RGBA{0xF5, 0xF7, 0xFA, 0xFF}
+	cardHeader     = color.RGBA{0x2A, 0xAB, 0xEE, 0xFF} // Telegram blue
+	cardText       = color.RGBA{0x22, 0x22, 0x22, 0xFF}
+)
+
+// cardTemplate lays out the card text: the first line is the header, the rest are facts.
+var cardTemplate = template.Must(template.New("card").Parse(
+	"{{.Name}}\n{{range .Facts}}{{.Key}}: {{.Value}}\n{{end}}"))
+
+type cardFact struct {
+	Key   string
+	Value string
+}
+
+// renderCard draws the user's name and facts onto a PNG image. Glyphs Go Mono lacks,
+// such as emoji, are drawn as placeholder boxes.
+func renderCard(name string, userData map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(userData))
+	for k := range userData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	facts := make([]cardFact, 0, len(keys))
+	for _, k := range keys {
+		facts = append(facts, cardFact{Key: k, Value: userData[k]})
+	}
+
+	var buf bytes.Buffer
+	err := cardTemplate.Execute(&buf, struct {
+		Name  string
+		Facts []cardFact
+	}{Name: name, Facts: facts})
+	if err != nil {
+		return nil, fmt.Errorf("render card template: %w", err)
+	}
+
+	// Faces are not safe for concurrent use, so each card gets its own.
+	face, err := opentype.NewFace(cardFont, &opentype.FaceOptions{Size: cardFontSize, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("load card font: %w", err)
+	}
+	defer face.Close()
+	advance, _ := face.GlyphAdvance('0')
+	ascent := face.Metrics().Ascent.Ceil()
+
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	header, body := lines[0], wrapLines(lines[1:], (cardWidth-2*cardPadding)/advance.Ceil())
+
+	height := cardHeaderSize + cardPadding*2 + len(body)*cardLineHeight
+	img := image.NewRGBA(image.Rect(0, 0, cardWidth, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{cardBackground}, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, cardWidth, cardHeaderSize), &image.Uniform{cardHeader}, image.Point{}, draw.Src)
+
+	drawer := &font.Drawer{Dst: img, Face: face}
+
+	drawer.Src = image.White
+	drawer.Dot = fixed.P(cardPadding, cardHeaderSize/2+ascent/2)
+	drawer.DrawString(header)
+
+	drawer.Src = &image.Uniform{cardText}
+	for i, line := range body {
+		drawer.Dot = fixed.P(cardPadding, cardHeaderSize+cardPadding+(i+1)*cardLineHeight-cardLineHeight/4)
+		drawer.DrawString(line)
+	}
+
+	buf.Reset()
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encode card: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// wrapLines hard-wraps every line to at most width runes.
+func wrapLines(lines []string, width int) []string {
+	var out []string
+	for _, line := range lines {
+		runes := []rune(line)
+		for len(runes) > width {
+			out = append(out, string(runes[:width]))
+			runes = runes[width:]
+		}
+		out = append(out, string(runes))
+	}
+	return out
+}
+
+// --- Bot Logic Handlers ---
+
+// handleStart initiates the conversation.
+func handleStart(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	kind := chooseGreeting(session, time.Now())
+	reply := renderGreeting(kind, update.Message.From.FirstName, session, time.Now())
+
+	if kind == GreetingNew && !session.TutorialOffered {
+		reply += "\n\nNew here? Send /tutorial for a quick tour."
+		session.TutorialOffered = true
+	}
+
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+	if kind == GreetingResume {
+		// Keep the conversation going; the greeting repeats what the bot was asking.
+		_, msg.ReplyMarkup = resumePrompt(session)
+	} else {
+		msg.ReplyMarkup = mainKeyboard
+		session.State = StateChoosing
+	}
+	send(bot, session, msg)
+	track(EventSessionStarted, update.Message.From.ID, map[string]string{
+		"returning": strconv.FormatBool(len(session.UserData) > 0 && seenBefore(session)),
+		"greeting":  string(kind),
+	})
+}
+
+// --- Greetings ---
+
+// GreetingKind says which /start greeting a session gets.
+type GreetingKind string
+
+const (
+	GreetingNew         GreetingKind = "new"          // Nothing known about the user yet
+	GreetingReturning   GreetingKind = "returning"    // Known facts, seen recently
+	GreetingLongAbsence GreetingKind = "long_absence" // Last contact more than greetingAbsence ago
+	GreetingResume      GreetingKind = "resume"       // In the middle of a conversation
+)
+
+// greetingAbsence is how long a user must be away to be welcomed back.
+// Overridden by GREETING_ABSENCE (a Go duration, e.g. "168h").
+var greetingAbsence = 30 * 24 * time.Hour
+
+// greetingTemplates is the catalog of /start greetings. The resume greeting is
+// followed by the question the bot was waiting on (see resumePrompt).
+var greetingTemplates = map[GreetingKind]*template.Template{
+	GreetingNew: template.Must(template.New("new").Parse(
+		"Hi{{if .Name}} {{.Name}}{{end}}! My name is Doctor Botter. I will hold a more complex conversation with you. Why don't you tell me something about yourself?")),
+	GreetingReturning: template.Must(template.New("returning").Parse(
+		"Hi{{if .Name}} {{.Name}}{{end}}! My name is Doctor Botter. You already told me your {{.Facts}}. Why don't you tell me something more about yourself? Or change anything I already know.")),
+	GreetingLongAbsence: template.Must(template.New("long_absence").Parse(
+		"Welcome back{{if .Name}}, {{.Name}}{{end}}! It has been {{.Absence}} since we last talked.{{if .Facts}} I still remember your {{.Facts}}. Has anything changed?{{else}} Why don't you tell me something about yourself?{{end}}")),
+	GreetingResume: template.Must(template.New("resume").Parse(
+		"Welcome back{{if .Name}}, {{.Name}}{{end}}! We were in the middle of something.\n\n{{.Prompt}}\n\nSend /cancel to start over instead.")),
+}
+
+// chooseGreeting picks a greeting from the session's history.
+func chooseGreeting(session *UserSession, now time.Time) GreetingKind {
+	switch {
+	case session.State != StateChoosing:
+		return GreetingResume
+	case session.LastUpdated > 0 && now.Sub(time.Unix(session.LastUpdated, 0)) > greetingAbsence:
+		return GreetingLongAbsence
+	case len(session.UserData) > 0 && seenBefore(session):
+		return GreetingReturning
+	}
+	return GreetingNew
+}
+
+// seenBefore reports whether the user wrote to the bot before the current update.
+// LastUpdated is set once an update is processed, so a session with FirstSeen but no
+// LastUpdated was created by import-users; one with neither predates FirstSeen.
+func seenBefore(session *UserSession) bool {
+	return session.LastUpdated > 0 || session.FirstSeen == 0
+}
+
+// renderGreeting fills in the greeting template for kind.
+func renderGreeting(kind GreetingKind, name string, session *UserSession, now time.Time) string {
+	keys := make([]string, 0, len(session.UserData))
+	for k := range session.UserData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var prompt, absence string
+	if kind == GreetingResume {
+		prompt, _ = resumePrompt(session)
+	}
+	if session.LastUpdated > 0 {
+		absence = fmt.Sprintf("%d days", int(now.Sub(time.Unix(session.LastUpdated, 0)).Hours()/24))
+	}
+
+	var buf bytes.Buffer
+	err := greetingTemplates[kind].Execute(&buf, struct {
+		Name, Facts, Prompt, Absence string
+	}{Name: name, Facts: strings.Join(keys, ", "), Prompt: prompt, Absence: absence})
+	if err != nil {
+		log.Printf("[ERROR] Failed to render %s greeting: %v", kind, err)
+		return "Hi! My name is Doctor Botter."
+	}
+	return buf.String()
+}
+
+// handleRegularChoice handles predefined categories.
+func handleRegularChoice(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	chooseCategory(update, session, bot, normalizeKey(update.Message.Text))
+}
+
+// chooseCategory makes key the current category and asks for its value.
+func chooseCategory(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI, key string) {
+	session.CurrentKey = key
+
+	var replyText string
+	if val, ok := session.UserData[key]; ok {
+		replyText = fmt.Sprintf("Your %s? I already know the following about that: %s", key, val)
+	} else {
+		replyText = fmt.Sprintf("Your %s? Yes, I would love to hear about that!", key)
+	}
+
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, replyText)
+	msg.ReplyMarkup = inputHint(valuePlaceholder(key))
+	send(bot, session, msg)
+	session.State = StateTypingReply
+	if session.ConversationFlow == "" {
+		startConversation(session, "main", time.Now())
+	}
+}
+
+// handleCustomChoice asks for a custom category name.
+func handleCustomChoice(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Alright, please send me the category first, for example \"Most impressive skill\"")
+	msg.ReplyMarkup = inputHint(customChoicePlaceholder)
+	send(bot, session, msg)
+	session.State = StateTypingChoice
+	if session.ConversationFlow == "" {
+		startConversation(session, "main", time.Now())
+	}
+}
+
+// handleReceivedInformation saves the user input.
+func handleReceivedInformation(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	text := update.Message.Text
+	category := session.CurrentKey
+	if err := setFact(session, category, normalizeValue(category, text), update.UpdateID); err != nil {
+		replyQuotaError(update, session, bot, err)
+		return
+	}
+	session.CurrentKey = "" // Clear temporary choice
+	track(EventFactSaved, update.Message.From.ID, map[string]string{"category": analyticsCategory(category)})
+
+	msgText := fmt.Sprintf("Neat! Just so you know, this is what you already told me:\n%s\nYou can tell me more, or change your opinion on something.", factsToString(session.UserData))
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, msgText)
+	msg.ReplyMarkup = mainKeyboard
+	send(bot, session, msg)
+	session.State = StateChoosing
+}
+
+// replyQuotaError tells the user why their answer was not saved. The session stays
+// in its current state so they can send a shorter answer or /cancel.
+func replyQuotaError(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI, err error) {
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) {
+		log.Printf("[ERROR] Failed to save fact for user %d: %v", update.Message.From.ID, err)
+		return
+	}
+	log.Printf("[WARN] Quota hit for user %d: %v", update.Message.From.ID, err)
+	send(bot, session, tgbotapi.NewMessage(update.Message.Chat.ID, quotaErr.Message))
+}
+
+// handleTypedChoice treats the typed text as a custom category name
+// and reuses the regular_choice logic for setting the key.
+func handleTypedChoice(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	key := normalizeKey(update.Message.Text)
+	if key == "" {
+		send(bot, session, tgbotapi.NewMessage(update.Message.Chat.ID, "Please send a category name with some letters in it, for example \"Most impressive skill\""))
+		return
+	}
+	chooseCategory(update, session, bot, key)
+}
+
+// handleDone finishes the interaction.
+func handleDone(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	endConversation(session, "completed", update.Message.From.ID, time.Now())
+	session.CurrentKey = ""
+	msgText := fmt.Sprintf("I learned these facts about you:\n%s\nUntil next time!", factsToString(session.UserData))
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, msgText)
+	msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+	send(bot, session, msg)
+	track(EventDone, update.Message.From.ID, map[string]string{"facts": strconv.Itoa(len(session.UserData))})
+
+	// In the Python example, ConversationHandler.END is returned.
+	// Here we just reset state to Choosing (waiting for start) or keep it in Choosing but without a keyboard.
+	// To match persistence behavior strictly, we might leave the session active but waiting for /start.
+	// For this implementation, we reset to 'Choosing' logically for the next interaction,
+	// effectively waiting for a command or new text that matches filters.
+	session.State = StateChoosing
+}
+
+// handleShowData displays gathered info (command handler).
+func handleShowData(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	msgText := fmt.Sprintf("This is what you already told me:\n%s", factsToString(session.UserData))
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, msgText)
+	send(bot, session, msg)
+
+	if session.State == StateTutorial && session.QuestionIndex == tutorialShowData {
+		session.QuestionIndex++
+		sendTutorialStep(update, session, bot, "")
+	}
+}
+
+// handleCard sends the user's profile as a shareable image.
+func handleCard(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	if len(session.UserData) == 0 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "I don't know anything about you yet. Send /start and tell me something first!")
+		send(bot, session, msg)
+		return
+	}
+
+	name := strings.TrimSpace(update.Message.From.FirstName + " " + update.Message.From.LastName)
+	if name == "" {
+		name = update.Message.From.UserName
+	}
+
+	data, err := renderCard(name, session.UserData)
+	if err != nil {
+		log.Printf("[ERROR] Failed to render card for user %d: %v", update.Message.From.ID, err)
+		send(bot, session, tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I couldn't draw your card right now. Here is what I know instead:\n"+factsToString(session.UserData)))
+		return
+	}
+
+	photo := tgbotapi.NewPhoto(update.Message.Chat.ID, tgbotapi.FileBytes{Name: "card.png", Bytes: data})
+	photo.Caption = "Here is everything I know about you."
+	send(bot, session, photo)
+}
+
+// handleFeedback starts the feedback mini-conversation.
+func handleFeedback(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	if adminChatID == 0 {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, feedback is not available right now.")
+		send(bot, session, msg)
+		return
+	}
+	if err := checkTicketQuota(session, ""); err != nil {
+		replyQuotaError(update, session, bot, err)
+		return
+	}
+
+	session.Suspend()
+	session.State = StateTypingFeedback
+	startConversation(session, "feedback", time.Now())
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, feedbackPrompt)
+	msg.ReplyMarkup = inputHint(feedbackPlaceholder)
+	send(bot, session, msg)
+}
+
+const feedbackPrompt = "What would you like to tell the team? Send your message, or /cancel to go back."
+
+const batchPrompt = "Send several facts in one message, one per line as \"category: value\", for example:\nage: 30\nfavourite colour: green\n\nOr /cancel to go back."
+
+// handleBatch lets the user fill several categories with one message.
+func handleBatch(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	session.Suspend()
+	session.State = StateTypingBatch
+	startConversation(session, "batch", time.Now())
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, batchPrompt)
+	msg.ReplyMarkup = inputHint(batchPlaceholder)
+	send(bot, session, msg)
+}
+
+// handleReceivedBatch stores every valid "category: value" line and reports on each one.
+func handleReceivedBatch(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	report, saved := applyBatch(session, update.Message.Text, update.UpdateID)
+	if len(report) == 0 {
+		send(bot, session, tgbotapi.NewMessage(update.Message.Chat.ID, batchPrompt))
+		return
+	}
+	for _, key := range saved {
+		track(EventFactSaved, update.Message.From.ID, map[string]string{"category": analyticsCategory(key), "batch": "true"})
+	}
+	log.Printf("[INFO] Batch from user %d: %d of %d line(s) saved", update.Message.From.ID, len(saved), len(report))
+	finishConversation(update, session, bot, "completed", strings.Join(report, "\n"))
+}
+
+// applyBatch parses one "category: value" pair per line and saves each through setFact,
+// so batch answers obey the same normalization and quotas as the button flow. It returns
+// a report line per non-empty input line and the keys that were saved.
+func applyBatch(session *UserSession, text string, updateID int) (report, saved []string) {
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		rawKey, value, ok := strings.Cut(line, ":")
+		key := normalizeKey(rawKey)
+		value = normalizeValue(key, value)
+		var problem string
+		switch {
+		case !ok:
+			problem = "expected \"category: value\""
+		case key == "":
+			problem = "the category is missing"
+		case value == "":
+			problem = "the value is missing"
+		}
+		if problem == "" {
+			if err := setFact(session, key, value, updateID); err != nil {
+				var quotaErr *QuotaError
+				if !errors.As(err, &quotaErr) {
+					log.Printf("[ERROR] Failed to save batch fact for %q: %v", key, err)
+					problem = "could not be saved"
+				} else {
+					problem = quotaErr.Message
+				}
+			}
+		}
+		if problem != "" {
+			report = append(report, fmt.Sprintf("✗ line %d: %s", i+1, problem))
+			continue
+		}
+		report = append(report, fmt.Sprintf("✓ %s: %s", key, value))
+		saved = append(saved, key)
+	}
+	return report, saved
+}
+
+// handleReceivedFeedback opens a ticket for the user's feedback and relays it to the admin chat.
+func handleReceivedFeedback(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	from := update.Message.From
+	if err := checkTicketQuota(session, update.Message.Text); err != nil {
+		replyQuotaError(update, session, bot, err)
+		return
+	}
+	now := time.Now().Unix()
+	ticket := &Ticket{
+		ID:        fmt.Sprintf("%d-%d", from.ID, len(session.Tickets)+1),
+		Text:      update.Message.Text,
+		Status:    TicketOpen,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	session.Tickets = append(session.Tickets, ticket)
+	log.Printf("[INFO] Opened ticket %s for user %d", ticket.ID, from.ID)
+
+	adminText := fmt.Sprintf("Ticket %s from @%s (user_id %d):\n%s\n\nReply with /admin reply %d <text>, close with /admin close %s", ticket.ID, from.UserName, from.ID, ticket.Text, from.ID, ticket.ID)
+	if err := send(bot, nil, tgbotapi.NewMessage(adminChatID, adminText)); err != nil {
+		log.Printf("[ERROR] Failed to forward feedback from user %d: %v", from.ID, err)
+	} else {
+		log.Printf("[INFO] Forwarded feedback from user %d to admin chat", from.ID)
+	}
+
+	finishConversation(update, session, bot, "completed", fmt.Sprintf("Thanks! Your message has been passed on to the team as ticket %s. Check on it any time with /ticket.", ticket.ID))
+}
+
+// handleTicketStatus lists the user's tickets and their status.
+func handleTicketStatus(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	if len(session.Tickets) == 0 {
+		send(bot, session, tgbotapi.NewMessage(update.Message.Chat.ID, "You have no tickets. Use /feedback to write to the team."))
+		return
+	}
+
+	lines := make([]string, 0, len(session.Tickets))
+	for _, ticket := range session.Tickets {
+		lines = append(lines, fmt.Sprintf("%s - %s", ticket.ID, ticket.Status))
+	}
+	send(bot, session, tgbotapi.NewMessage(update.Message.Chat.ID, "Your tickets:\n"+strings.Join(lines, "\n")))
+}
+
+// Tutorial steps, kept in UserSession.QuestionIndex while in StateTutorial.
+const (
+	tutorialPickCategory = iota
+	tutorialAnswer
+	tutorialShowData
+	tutorialFinish
+)
+
+// handleTutorial starts a guided tour of the main flow: pick a category, answer it,
+// look at the data and finish. It suspends whatever the user was doing.
+func handleTutorial(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	session.Suspend()
+	session.State = StateTutorial
+	session.QuestionIndex = tutorialPickCategory
+	startConversation(session, "tutorial", time.Now())
+	session.TutorialOffered = true
+	track(EventTutorial, update.Message.From.ID, map[string]string{"step": "started"})
+	sendTutorialStep(update, session, bot, "Welcome to the tour! It takes four steps, and /cancel stops it at any time.")
+}
+
+// tutorialPrompt explains the current tutorial step.
+func tutorialPrompt(session *UserSession) (string, interface{}) {
+	switch session.QuestionIndex {
+	case tutorialPickCategory:
+		return "Step 1 of 4: pick a category by tapping one of the buttons below, for example \"Age\".", mainKeyboard
+	case tutorialAnswer:
+		return fmt.Sprintf("Step 2 of 4: now tell me your %s. Just type it and send.", session.CurrentKey), inputHint(valuePlaceholder(session.CurrentKey))
+	case tutorialShowData:
+		return "Step 3 of 4: send /show_data to see everything I know about you.", tgbotapi.NewRemoveKeyboard(true)
+	default:
+		return "Step 4 of 4: tap \"Done\" when you have told me enough.", mainKeyboard
+	}
+}
+
+// sendTutorialStep sends the current step, with an optional lead-in line.
+func sendTutorialStep(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI, lead string) {
+	prompt, markup := tutorialPrompt(session)
+	if lead != "" {
+		prompt = lead + "\n\n" + prompt
+	}
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, prompt)
+	msg.ReplyMarkup = markup
+	send(bot, session, msg)
+}
+
+// handleTutorialInput checks the user did what the current step asked and moves on.
+// Anything else repeats the step.
+func handleTutorialInput(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	text := strings.TrimSpace(update.Message.Text)
+	switch session.QuestionIndex {
+	case tutorialPickCategory:
+		category := categoryByLabel(text)
+		if category == nil {
+			sendTutorialStep(update, session, bot, "Please tap one of the categories, such as \"Age\".")
+			return
+		}
+		session.CurrentKey = normalizeKey(category.Label)
+		session.QuestionIndex++
+		sendTutorialStep(update, session, bot, "Good choice!")
+	case tutorialAnswer:
+		if text == "" {
+			sendTutorialStep(update, session, bot, "")
+			return
+		}
+		if err := setFact(session, session.CurrentKey, normalizeValue(session.CurrentKey, text), update.UpdateID); err != nil {
+			replyQuotaError(update, session, bot, err)
+			return
+		}
+		track(EventFactSaved, update.Message.From.ID, map[string]string{"category": analyticsCategory(session.CurrentKey), "tutorial": "true"})
+		session.CurrentKey = ""
+		session.QuestionIndex++
+		sendTutorialStep(update, session, bot, "Saved! Outside the tutorial you can change it the same way whenever you like.")
+	case tutorialShowData:
+		sendTutorialStep(update, session, bot, "Almost: this step needs the command.")
+	default:
+		if !strings.EqualFold(text, "Done") {
+			sendTutorialStep(update, session, bot, "")
+			return
+		}
+		track(EventTutorial, update.Message.From.ID, map[string]string{"step": "completed"})
+		finishConversation(update, session, bot, "completed", "That's the whole tour! Tell me more about yourself with the buttons below, or try /batch to send several facts at once.")
+	}
+}
+
+// handleQuestionnaireStart begins the scripted flow registered for the command.
+func handleQuestionnaireStart(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	q := questionnaires[update.Message.Command()]
+	session.Suspend()
+	session.Questionnaire = q.Command
+	session.State = StateQuestionnaire
+	startConversation(session, "questionnaire/"+q.Command, time.Now())
+
+	if q.Intro != "" {
+		send(bot, session, tgbotapi.NewMessage(update.Message.Chat.ID, q.Intro))
+	}
+	askQuestion(update, session, bot, q)
+}
+
+func askQuestion(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI, q *Questionnaire) {
+	question := q.Questions[session.QuestionIndex]
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, question.Prompt)
+	msg.ReplyMarkup = question.markup()
+	send(bot, session, msg)
+}
+
+// markup shows the question's placeholder in the input box, or just hides the keyboard.
+func (q Question) markup() interface{} {
+	if q.Placeholder != "" {
+		return inputHint(q.Placeholder)
+	}
+	return tgbotapi.NewRemoveKeyboard(true)
+}
+
+// handleQuestionnaireAnswer validates and stores the answer, then moves to the next question.
+func handleQuestionnaireAnswer(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	q, ok := questionnaires[session.Questionnaire]
+	if !ok || session.QuestionIndex >= len(q.Questions) {
+		// The script changed or was removed since this session started it.
+		log.Printf("[WARN] Questionnaire %q no longer available for user %d, returning to menu", session.Questionnaire, update.Message.From.ID)
+		finishConversation(update, session, bot, "cancelled", "That questionnaire is no longer available.")
+		return
+	}
+
+	question := q.Questions[session.QuestionIndex]
+	text := strings.TrimSpace(update.Message.Text)
+	if question.pattern != nil && !question.pattern.MatchString(text) {
+		reply := question.Error
+		if reply == "" {
+			reply = "Sorry, I didn't understand that. " + question.Prompt
+		}
+		send(bot, session, tgbotapi.NewMessage(update.Message.Chat.ID, reply))
+		return
+	}
+
+	if err := setFact(session, question.Key, normalizeValue(question.Key, text), update.UpdateID); err != nil {
+		replyQuotaError(update, session, bot, err)
+		return
+	}
+	track(EventFactSaved, update.Message.From.ID, map[string]string{"category": analyticsCategory(question.Key), "questionnaire": q.Command})
+
+	session.QuestionIndex = q.nextQuestion(session.QuestionIndex, session.UserData)
+	if session.QuestionIndex < len(q.Questions) {
+		askQuestion(update, session, bot, q)
+		return
+	}
+
+	outro := q.Outro
+	if outro == "" {
+		outro = "Thanks, that's all!"
+	}
+	finishConversation(update, session, bot, "completed", fmt.Sprintf("%s This is what you already told me:\n%s", outro, factsToString(session.UserData)))
+}
+
+// finishConversation ends the active conversation with result ("completed" or
+// "cancelled") and text. If another conversation was interrupted by it, that one is
+// resumed and its pending question repeated.
+func finishConversation(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI, result, text string) {
+	endConversation(session, result, update.Message.From.ID, time.Now())
+	var msg tgbotapi.MessageConfig
+	if session.Resume() {
+		prompt, markup := resumePrompt(session)
+		msg = tgbotapi.NewMessage(update.Message.Chat.ID, text+"\n\n"+prompt)
+		msg.ReplyMarkup = markup
+	} else {
+		msg = tgbotapi.NewMessage(update.Message.Chat.ID, text)
+		msg.ReplyMarkup = mainKeyboard
+	}
+	send(bot, session, msg)
+}
+
+// resumePrompt repeats what the bot was waiting for in the (just resumed) active conversation.
+func resumePrompt(session *UserSession) (string, interface{}) {
+	switch session.State {
+	case StateTypingReply:
+		return fmt.Sprintf("Back to where we were: your %s?", session.CurrentKey), inputHint(valuePlaceholder(session.CurrentKey))
+	case StateTypingChoice:
+		return "Back to where we were: please send me the category first, for example \"Most impressive skill\"", inputHint(customChoicePlaceholder)
+	case StateTypingFeedback:
+		return "Back to your feedback: " + feedbackPrompt, inputHint(feedbackPlaceholder)
+	case StateTypingBatch:
+		return "Back to where we were: " + batchPrompt, inputHint(batchPlaceholder)
+	case StateTutorial:
+		prompt, markup := tutorialPrompt(session)
+		return "Back to the tutorial. " + prompt, markup
+	case StateQuestionnaire:
+		if q, ok := questionnaires[session.Questionnaire]; ok && session.QuestionIndex < len(q.Questions) {
+			question := q.Questions[session.QuestionIndex]
+			return "Back to where we were: " + question.Prompt, question.markup()
+		}
+		session.reset()
+	}
+	return "What would you like to tell me?", mainKeyboard
+}
+
+// handleCancel abandons whatever the user was typing and returns to the main menu,
+// or to the conversation it interrupted.
+func handleCancel(update *tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	text := "Okay, never mind. What would you like to tell me?"
+	if len(session.Suspended) > 0 {
+		text = "Okay, never mind."
+	}
+	finishConversation(update, session, bot, "cancelled", text)
+}
+
+const adminUsage = "Usage:\n/admin reply <user_id> <text>\n/admin tickets\n/admin assign <ticket_id> <admin>\n/admin close <ticket_id>\n/admin stats\n/admin erase <user_id>\n/admin loglevel <debug|info|warn|error>\n/admin debug on|off"
+
+// handleAdmin dispatches /admin subcommands. It only answers in the admin chat.
+func handleAdmin(update *tgbotapi.Update, _ *UserSession, bot *tgbotapi.BotAPI) {
+	if adminChatID == 0 || update.Message.Chat.ID != adminChatID {
+		log.Printf("[WARN] Rejected /admin from chat %d (user %d)", update.Message.Chat.ID, update.Message.From.ID)
+		return
+	}
+
+	args := strings.Fields(update.Message.CommandArguments())
+	if len(args) == 0 {
+		send(bot, nil, tgbotapi.NewMessage(adminChatID, adminUsage))
+		return
+	}
+
+	switch args[0] {
+	case "reply":
+		userID, text, err := parseAdminReply(update.Message.CommandArguments())
+		if err != nil {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, err.Error()))
+			return
+		}
+		if err := send(bot, store.GetSession(userID), tgbotapi.NewMessage(userID, "Reply from the team:\n"+text)); err != nil {
+			log.Printf("[ERROR] Failed to relay admin reply to user %d: %v", userID, err)
+			// Only the kind goes to the admin chat; the full error stays in the log.
+			kind := SendBlocked
+			var sendErr *SendError
+			if errors.As(err, &sendErr) {
+				kind = sendErr.Kind
+			}
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("Could not deliver the reply to %d (%s).", userID, kind)))
+			return
+		}
+		log.Printf("[INFO] Relayed admin reply to user %d", userID)
+		send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("Reply delivered to %d.", userID)))
+	case "tickets":
+		tickets := store.OpenTickets()
+		if len(tickets) == 0 {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, "No open tickets."))
+			return
+		}
+		lines := make([]string, 0, len(tickets))
+		for _, ticket := range tickets {
+			assignee := ticket.Assignee
+			if assignee == "" {
+				assignee = "unassigned"
+			}
+			lines = append(lines, fmt.Sprintf("%s [%s] %s", ticket.ID, assignee, ticket.Text))
+		}
+		send(bot, nil, tgbotapi.NewMessage(adminChatID, "Open tickets:\n"+strings.Join(lines, "\n")))
+	case "assign":
+		if len(args) != 3 {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, "Usage: /admin assign <ticket_id> <admin>"))
+			return
+		}
+		_, ticket := store.FindTicket(args[1])
+		if ticket == nil {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("No ticket %q.", args[1])))
+			return
+		}
+		ticket.Assignee = args[2]
+		ticket.UpdatedAt = time.Now().Unix()
+		log.Printf("[INFO] Ticket %s assigned to %s", ticket.ID, ticket.Assignee)
+		send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("Ticket %s assigned to %s.", ticket.ID, ticket.Assignee)))
+	case "close":
+		if len(args) != 2 {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, "Usage: /admin close <ticket_id>"))
+			return
+		}
+		userID, ticket := store.FindTicket(args[1])
+		if ticket == nil {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("No ticket %q.", args[1])))
+			return
+		}
+		ticket.Status = TicketClosed
+		ticket.UpdatedAt = time.Now().Unix()
+		log.Printf("[INFO] Ticket %s closed", ticket.ID)
+		send(bot, store.GetSession(userID), tgbotapi.NewMessage(userID, fmt.Sprintf("Your ticket %s has been closed. Thanks for the feedback!", ticket.ID)))
+		send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("Ticket %s closed.", ticket.ID)))
+	case "stats":
+		store.RLock()
+		total := len(store.Sessions)
+		store.RUnlock()
+		text := fmt.Sprintf("Sessions: %d\nBlocked the bot: %d\nSend errors: transient %s, permanent %s, blocked %s",
+			total, store.BlockedCount(), expvarCount(sendErrors, SendTransient.String()),
+			expvarCount(sendErrors, SendPermanent.String()), expvarCount(sendErrors, SendBlocked.String()))
+		send(bot, nil, tgbotapi.NewMessage(adminChatID, text))
+	case "loglevel":
+		if len(args) != 2 {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, "Usage: /admin loglevel <debug|info|warn|error>"))
+			return
+		}
+		level, err := parseLogLevel(args[1])
+		if err != nil {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, err.Error()))
+			return
+		}
+		logLevel.min.Store(level)
+		log.Printf("[WARN] Log level set to %s by admin chat", strings.ToLower(args[1]))
+		send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("Log level is now %s.", strings.ToLower(args[1]))))
+	case "debug":
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, "Usage: /admin debug on|off"))
+			return
+		}
+		telegramDebug.Store(args[1] == "on")
+		log.Printf("[WARN] Telegram API debug logging turned %s by admin chat", args[1])
+		send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("Telegram API debug logging is %s.", args[1])))
+	case "erase":
+		if len(args) != 2 {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, "Usage: /admin erase <user_id>"))
+			return
+		}
+		userID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("Invalid user_id %q.", args[1])))
+			return
+		}
+		if err := store.EraseFacts(userID); err != nil {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("Could not erase %d: %v", userID, err)))
+			return
+		}
+		send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("Facts of %d erased; their data key is gone.", userID)))
+	default:
+		send(bot, nil, tgbotapi.NewMessage(adminChatID, fmt.Sprintf("Unknown admin command %q.", args[0])))
+	}
+}
+
+// expvarCount renders a counter from an expvar map, treating a missing key as zero.
+func expvarCount(m *expvar.Map, key string) string {
+	if v := m.Get(key); v != nil {
+		return v.String()
+	}
+	return "0"
+}
+
+// parseAdminReply splits "reply <user_id> <text>" into its parts.
+func parseAdminReply(args string) (int64, string, error) {
+	parts := strings.SplitN(strings.TrimSpace(args), " ", 3)
+	if len(parts) < 3 || strings.TrimSpace(parts[2]) == "" {
+		return 0, "", fmt.Errorf("Usage: /admin reply <user_id> <text>")
+	}
+	userID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("Invalid user_id %q", parts[1])
+	}
+	return userID, strings.TrimSpace(parts[2]), nil
+}
+
+// appliedUpdateWindow bounds AppliedUpdateIDs. Replays come from an unconfirmed
+// getUpdates batch (at most 100 updates, usually a handful for one user).
+const appliedUpdateWindow = 32
+
+// appliedUpdate reports whether id is among the recently applied update_ids.
+func (s *UserSession) appliedUpdate(id int) bool {
+	for _, applied := range s.AppliedUpdateIDs {
+		if applied == id {
+			return true
+		}
+	}
+	return false
+}
+
+// recordUpdate remembers id as applied, evicting the oldest entry past the window.
+func (s *UserSession) recordUpdate(id int) {
+	if id == 0 {
+		return
+	}
+	s.AppliedUpdateIDs = append(s.AppliedUpdateIDs, id)
+	if n := len(s.AppliedUpdateIDs); n > appliedUpdateWindow {
+		s.AppliedUpdateIDs = append(s.AppliedUpdateIDs[:0:0], s.AppliedUpdateIDs[n-appliedUpdateWindow:]...)
+	}
+}
+
+// ProcessUpdate routes the update based on state and content.
+// This function is separated for testability.
+func ProcessUpdate(update tgbotapi.Update, session *UserSession, bot *tgbotapi.BotAPI) {
+	if update.Message == nil {
+		return
+	}
+
+	// Telegram re-delivers updates whose offset was never confirmed (e.g. a crash
+	// after Save but before the next poll). A recently applied update_id has already
+	// mutated the session and sent its reply. Only exact matches are dropped: update_ids
+	// restart from a random value when the bot is re-created, so "lower than the last
+	// one" does not mean "seen".
+	if update.UpdateID != 0 && session.appliedUpdate(update.UpdateID) {
+		log.Printf("[INFO] Skipping replayed update %d", update.UpdateID)
+		return
+	}
+	session.recordUpdate(update.UpdateID)
+	// Set on the way out so handlers (the /start greeting) still see the previous contact.
+	defer func() { session.LastUpdated = time.Now().Unix() }()
+
+	// A message from the user proves they unblocked the bot.
+	if session.Blocked {
+		session.Blocked = false
+		log.Printf("[INFO] User %d wrote again, clearing blocked flag", update.Message.From.ID)
+	}
+
+	if reason := guard.Check(update); reason != "" {
+		log.Printf("[INFO] Suppressed update %d from user %d: %s", update.UpdateID, update.Message.From.ID, reason)
+		return
+	}
+
+	if store != nil && store.ReadOnly && mutatesSession(update) {
+		log.Printf("[INFO] Storage read-only, deferring user %d", update.Message.From.ID)
+		send(bot, session, tgbotapi.NewMessage(update.Message.Chat.ID, readOnlyReply))
+		return
+	}
+
+	text := update.Message.Text
+
+	// Global Commands
+	if update.Message.IsCommand() {
+		track(EventCommandUsed, update.Message.From.ID, map[string]string{"command": analyticsCommand(update.Message.Command())})
+		switch update.Message.Command() {
+		case "start":
+			runHandler("handleStart", handleStart, &update, session, bot)
+			return
+		case "show_data":
+			runHandler("handleShowData", handleShowData, &update, session, bot)
+			return
+		case "card":
+			runHandler("handleCard", handleCard, &update, session, bot)
+			return
+		case "feedback":
+			runHandler("handleFeedback", handleFeedback, &update, session, bot)
+			return
+		case "batch":
+			runHandler("handleBatch", handleBatch, &update, session, bot)
+			return
+		case "tutorial":
+			runHandler("handleTutorial", handleTutorial, &update, session, bot)
+			return
+		case "ticket":
+			runHandler("handleTicketStatus", handleTicketStatus, &update, session, bot)
+			return
+		case "cancel":
+			runHandler("handleCancel", handleCancel, &update, session, bot)
+			return
+		case "admin":
+			runHandler("handleAdmin", handleAdmin, &update, session, bot)
+			return
+		default:
+			if _, ok := questionnaires[update.Message.Command()]; ok {
+				runHandler("handleQuestionnaireStart", handleQuestionnaireStart, &update, session, bot)
+				return
+			}
+		}
+	}
+
+	// Regex Filters
+	isDone := regexp.MustCompile("(?i)^Done$").MatchString(text)
+	isRegular := categoryByLabel(text) != nil
+	isCustom := text == customChoiceLabel
+
+	// State Machine
+	switch session.State {
+	case StateChoosing:
+		if isRegular {
+			runHandler("handleRegularChoice", handleRegularChoice, &update, session, bot)
+		} else if isCustom {
+			runHandler("handleCustomChoice", handleCustomChoice, &update, session, bot)
+		} else if isDone {
+			runHandler("handleDone", handleDone, &update, session, bot)
+		} else {
+			// Unknown input in Choosing state, re-show start or ignore
+			// Python bot ignores unknown text in CHOOSING usually unless it matches regex
+			log.Printf("[DEBUG] Ignored text in CHOOSING state: %s", text)
+		}
+
+	case StateTypingChoice:
+		// Python logic: The text entering here becomes the 'choice' (category)
+		// And we reuse 'regular_choice' logic which sets context.user_data["choice"]
+		// and moves to TYPING_REPLY
+		if !isDone { // Filter out "Done" if user changes mind? Python filters.TEXT & ~(COMMAND | Done)
+			runHandler("handleTypedChoice", handleTypedChoice, &update, session, bot)
+		} else {
+			runHandler("handleRegularChoice", handleRegularChoice, &update, session, bot) // Fallback if they clicked a button instead of typing?
+		}
+
+	case StateTypingReply:
+		if !isDone {
+			runHandler("handleReceivedInformation", handleReceivedInformation, &update, session, bot)
+		} else {
+			runHandler("handleDone", handleDone, &update, session, bot)
+		}
+
+	case StateTypingFeedback:
+		runHandler("handleReceivedFeedback", handleReceivedFeedback, &update, session, bot)
+
+	case StateQuestionnaire:
+		runHandler("handleQuestionnaireAnswer", handleQuestionnaireAnswer, &update, session, bot)
+
+	case StateTypingBatch:
+		runHandler("handleReceivedBatch", handleReceivedBatch, &update, session, bot)
+
+	case StateTutorial:
+		runHandler("handleTutorialInput", handleTutorialInput, &update, session, bot)
+	}
+}
+
+// --- Restart Recovery ---
+
+// processStarted is when this process began serving; sessions last touched before it
+// were interrupted by a restart.
+var processStarted = time.Now()
+
+// restartReminderWindow limits reminders to conversations left off recently; older
+// ones are picked up by the resume greeting on /start instead.
+const restartReminderWindow = 24 * time.Hour
+
+// pendingSinceRestart reports whether the user is mid-conversation in a state persisted
+// by a previous run, recently enough to be worth a message, and has not been reminded
+// since they last wrote.
+func pendingSinceRestart(session *UserSession) bool {
+	return session.State != StateChoosing && !session.Blocked &&
+		session.LastUpdated > 0 && session.LastUpdated < processStarted.Unix() &&
+		processStarted.Sub(time.Unix(session.LastUpdated, 0)) < restartReminderWindow &&
+		session.RestartRemindedAt < session.LastUpdated
+}
+
+// remindAfterRestart messages each user whose conversation was interrupted by a
+// restart with what the bot was waiting for. It runs before polling starts, so it
+// has the sessions to itself, and reports whether any session changed. It stops
+// early once stop is closed, leaving the rest for the next start.
+func remindAfterRestart(storage *ThreadSafeStorage, bot *tgbotapi.BotAPI, stop <-chan struct{}) bool {
+	reminded := 0
+	for userID, session := range storage.Sessions {
+		select {
+		case <-stop:
+			log.Printf("[INFO] Shutting down, stopped restart reminders after %d users", reminded)
+			return reminded > 0
+		default:
+		}
+		if !pendingSinceRestart(session) {
+			continue
+		}
+		prompt, markup := resumePrompt(session)
+		msg := tgbotapi.NewMessage(userID, "I was restarted since your last message, so here is where we were.\n\n"+prompt)
+		msg.ReplyMarkup = markup
+		if err := sendPaced(bot, session, msg); err != nil {
+			log.Printf("[WARN] Restart reminder to user %d failed: %v", userID, err)
+			continue
+		}
+		session.RestartRemindedAt = time.Now().Unix()
+		reminded++
+	}
+	if reminded > 0 {
+		log.Printf("[INFO] Reminded %d users of conversations interrupted by the restart", reminded)
+	}
+	return reminded > 0
+}
+
+// --- Session Events ---
+
+// SessionEvent describes a session after an update was applied to it. UserID is
+// passed through idObfuscator like analytics IDs; states use their stateName.
+type SessionEvent struct {
+	UserID    string `json:"user_id"`
+	UpdateID  int    `json:"update_id"`
+	FromState string `json:"from_state"`
+	State     string `json:"state"`
+	Facts     int    `json:"facts"`
+	Time      string `json:"time"`
+}
+
+// SessionEventBroker fans session events out to Server-Sent Events subscribers.
+type SessionEventBroker struct {
+	Token string // Bearer token required to subscribe
+
+	mu          sync.Mutex
+	subscribers map[chan SessionEvent]struct{}
+}
+
+func NewSessionEventBroker(token string) *SessionEventBroker {
+	return &SessionEventBroker{Token: token, subscribers: make(map[chan SessionEvent]struct{})}
+}
+
+// Publish delivers an event to every subscriber, dropping it for any that are too slow.
+func (b *SessionEventBroker) Publish(event SessionEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// ServeHTTP streams events as text/event-stream. Authenticate with
+// "Authorization: Bearer <token>" or ?token=<token> (for browser EventSource).
+func (b *SessionEventBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.Token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan SessionEvent, 64)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	log.Printf("[INFO] Session event subscriber connected from %s", r.RemoteAddr)
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("[INFO] Session event subscriber %s disconnected", r.RemoteAddr)
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case event := <-ch:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: session\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
+
+// sessionEvents is nil unless ADMIN_HTTP_TOKEN is set.
+var sessionEvents *SessionEventBroker
+
+// --- User Import ---
+
+// importRow is one line of a CRM export: a user ID and the facts known about them.
+type importRow struct {
+	Line   int
+	UserID int64
+	Facts  map[string]string
+}
+
+// parseImportCSV reads a CSV whose header is "user_id,<category>,<category>,...".
+// Empty cells are skipped; category names and values are normalised like typed facts.
+func parseImportCSV(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	if len(header) == 0 || strings.ToLower(strings.TrimSpace(header[0])) != "user_id" {
+		return nil, errors.New(`first column must be "user_id"`)
+	}
+	columns := make([]string, len(header))
+	for i, name := range header[1:] {
+		columns[i+1] = normalizeKey(name)
+	}
+
+	var rows []importRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		userID, err := strconv.ParseInt(strings.TrimSpace(record[0]), 10, 64)
+		if err != nil || userID <= 0 {
+			return nil, fmt.Errorf("line %d: invalid user_id %q", line, record[0])
+		}
+		row := importRow{Line: line, UserID: userID, Facts: make(map[string]string)}
+		for i, value := range record[1:] {
+			value = strings.TrimSpace(value)
+			if value != "" && columns[i+1] != "" {
+				row.Facts[columns[i+1]] = normalizeValue(columns[i+1], value)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// seedSession adds the row's facts to the user's session without overwriting
+// anything the user already told the bot. It returns how many facts were added.
+func seedSession(storage *ThreadSafeStorage, row importRow) int {
+	session := storage.GetOrCreateSession(row.UserID)
+	added := 0
+	for category, value := range row.Facts {
+		if _, exists := session.UserData[category]; exists {
+			continue
+		}
+		if err := setFact(session, category, value, 0); err != nil {
+			log.Printf("[WARN] Line %d: skipping %q for user %d: %v", row.Line, category, row.UserID, err)
+			continue
+		}
+		added++
+	}
+	if session.ImportedAt == 0 {
+		session.ImportedAt = time.Now().Unix()
+	}
+	return added
+}
+
+// runImportUsers implements "bot import-users <csv>". Seeding is idempotent and
+// introductions are recorded per user, so an interrupted run can simply be restarted.
+// Stop the bot before running it: both processes write the same storage file.
+func runImportUsers(args []string) error {
+	flags := flag.NewFlagSet("import-users", flag.ContinueOnError)
+	intro := flags.Bool("intro", false, "send each imported user an introduction message (needs TELEGRAM_TOKEN)")
+	introText := flags.String("intro-text", "Hi! My name is Doctor Botter. Send /start and tell me something about yourself.", "introduction message")
+	interval := flags.Duration("interval", time.Second, "pause between introduction messages")
+	force := flags.Bool("force", false, "import even if the storage failed its integrity check")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: bot import-users [--intro] [--intro-text text] [--interval 1s] [--force] <file.csv>")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	rows, err := parseImportCSV(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	storage := newStorageFromEnv(false)
+	if err := checkIntegrity(storage, *force); err != nil {
+		return err
+	}
+	seeded := 0
+	for _, row := range rows {
+		seeded += seedSession(storage, row)
+	}
+	storage.Save()
+	log.Printf("[INFO] Imported %d users, added %d facts", len(rows), seeded)
+
+	if !*intro {
+		return nil
+	}
+
+	token := os.Getenv("TELEGRAM_TOKEN")
+	if token == "" {
+		return errors.New("TELEGRAM_TOKEN is required for --intro")
+	}
+	bot, err := tgbotapi.NewBotAPI(token)
+	if err != nil {
+		return err
+	}
+
+	sent, skipped := 0, 0
+	for _, row := range rows {
+		session := storage.GetSession(row.UserID)
+		if session.IntroSentAt != 0 || session.Blocked {
+			skipped++
+			continue
+		}
+		err := sendPaced(bot, session, tgbotapi.NewMessage(row.UserID, *introText))
+		if err == nil {
+			session.IntroSentAt = time.Now().Unix()
+			sent++
+		} else {
+			log.Printf("[WARN] Intro to user %d (line %d) failed: %v", row.UserID, row.Line, err)
+		}
+		// Persist after every user so a restart resumes where this run stopped.
+		storage.Save()
+		time.Sleep(*interval)
+	}
+	log.Printf("[INFO] Introductions sent: %d, skipped (already sent or blocked): %d", sent, skipped)
+	return nil
+}
+
+// sendPaced sends a message, waiting out a 429 flood-control response once before giving up.
+func sendPaced(bot *tgbotapi.BotAPI, session *UserSession, c tgbotapi.Chattable) error {
+	err := send(bot, session, c)
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests && apiErr.RetryAfter > 0 {
+		log.Printf("[INFO] Rate limited, waiting %ds", apiErr.RetryAfter)
+		time.Sleep(time.Duration(apiErr.RetryAfter) * time.Second)
+		err = send(bot, session, c)
+	}
+	return err
+}
+
+// --- Save Strategies ---
+
+// Save metrics, published by expvar under /debug/vars when METRICS_ADDR is set.
+var (
+	storageSaves      = expvar.NewMap("storage_saves_total") // By result: ok, failed
+	storageSaveMs     = expvar.NewInt("storage_save_duration_ms_total")
+	storageUnsaved    = expvar.NewInt("storage_unsaved_updates") // Applied in memory, not yet on disk
+	storageSavePolicy = expvar.NewString("storage_save_strategy")
+)
+
+// Save strategies, picked with SAVE_STRATEGY.
+const (
+	SaveEveryUpdate = "every-update" // Save after each update (default, most durable)
+	SaveInterval    = "interval"     // Save every SAVE_INTERVAL if anything changed
+	SaveDebounce    = "debounce"     // Save once no update has arrived for SAVE_INTERVAL
+)
+
+// debounceMaxWait caps how many SAVE_INTERVALs a debounced save can be put off by a
+// steady stream of updates.
+const debounceMaxWait = 10
+
+// SavePolicy decides when the update loop writes storage. All methods are called from
+// the update loop goroutine, so a save never runs while a handler mutates a session.
+type SavePolicy struct {
+	Strategy string
+	Interval time.Duration // Period for interval, quiet time for debounce
+
+	pending int
+	since   time.Time // When the oldest pending update was applied (debounce)
+	ticker  *time.Ticker
+	timer   *time.Timer
+}
+
+// NewSavePolicy validates the strategy; interval is ignored for every-update.
+func NewSavePolicy(strategy string, interval time.Duration) (*SavePolicy, error) {
+	p := &SavePolicy{Strategy: strategy, Interval: interval}
+	switch strategy {
+	case SaveEveryUpdate:
+	case SaveInterval:
+		p.ticker = time.NewTicker(interval)
+	case SaveDebounce:
+		p.timer = time.NewTimer(interval)
+		p.timer.Stop()
+	default:
+		return nil, fmt.Errorf("unknown save strategy %q (want %s, %s or %s)", strategy, SaveEveryUpdate, SaveInterval, SaveDebounce)
+	}
+	storageSavePolicy.Set(strategy)
+	return p, nil
+}
+
+// Due fires when a deferred save should run. It never fires for every-update.
+func (p *SavePolicy) Due() <-chan time.Time {
+	switch {
+	case p.ticker != nil:
+		return p.ticker.C
+	case p.timer != nil:
+		return p.timer.C
+	}
+	return nil
+}
+
+// Changed is called after each applied update.
+func (p *SavePolicy) Changed(storage *ThreadSafeStorage) {
+	p.pending++
+	storageUnsaved.Set(int64(p.pending))
+	switch p.Strategy {
+	case SaveEveryUpdate:
+		p.save(storage)
+	case SaveDebounce:
+		if p.pending == 1 {
+			p.since = time.Now()
+		}
+		wait := p.Interval
+		if left := debounceMaxWait*p.Interval - time.Since(p.since); left < wait {
+			wait = left
+		}
+		p.timer.Reset(wait)
+	}
+}
+
+// Tick runs the deferred save once Due fires.
+func (p *SavePolicy) Tick(storage *ThreadSafeStorage) {
+	if p.pending > 0 {
+		p.save(storage)
+	}
+}
+
+// Flush saves unconditionally, for shutdown.
+func (p *SavePolicy) Flush(storage *ThreadSafeStorage) {
+	p.save(storage)
+}
+
+func (p *SavePolicy) save(storage *ThreadSafeStorage) {
+	start := time.Now()
+	ok := storage.Save()
+	storageSaveMs.Add(time.Since(start).Milliseconds())
+	if !ok {
+		storageSaves.Add("failed", 1)
+		return // Still pending, so the next tick retries
+	}
+	storageSaves.Add("ok", 1)
+	p.pending = 0
+	storageUnsaved.Set(0)
+}
+
+// newSavePolicyFromEnv reads SAVE_STRATEGY and SAVE_INTERVAL (default 5s).
+func newSavePolicyFromEnv() (*SavePolicy, error) {
+	strategy := os.Getenv("SAVE_STRATEGY")
+	if strategy == "" {
+		strategy = SaveEveryUpdate
+	}
+	interval := 5 * time.Second
+	if raw := os.Getenv("SAVE_INTERVAL"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("SAVE_INTERVAL must be a positive duration: %q", raw)
+		}
+		interval = d
+	}
+	return NewSavePolicy(strategy, interval)
+}
+
+// --- Process Lifecycle ---
+
+// shutdownTimeout bounds how long a stop signal waits for the update in flight.
+// Overridden by SHUTDOWN_TIMEOUT; keep it below the supervisor's grace period
+// (Kubernetes: terminationGracePeriodSeconds, 30s by default).
+var shutdownTimeout = 10 * time.Second
+
+// sdNotify sends a state such as "READY=1" to systemd when the bot runs as a
+// Type=notify unit. It is a no-op when NOTIFY_SOCKET is unset.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // Linux abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// lifecycle tracks the PID and ready files so they can be removed on the way out.
+type lifecycle struct {
+	PIDFile   string // PID_FILE: written once startup checks have passed
+	ReadyFile string // READY_FILE: exists only while the bot is polling, for readiness probes
+
+	claimed atomic.Bool // The PID file is ours; a shutdown before started leaves it alone
+}
+
+func (l *lifecycle) started() {
+	if l.PIDFile == "" {
+		return
+	}
+	if err := writeFileAtomic(l.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n")); err != nil {
+		log.Printf("[ERROR] Failed to write PID file %s: %v", l.PIDFile, err)
+		return
+	}
+	l.claimed.Store(true)
+}
+
+func (l *lifecycle) ready() {
+	if err := sdNotify("READY=1\nSTATUS=Polling for updates"); err != nil {
+		log.Printf("[WARN] sd_notify READY failed: %v", err)
+	}
+	if l.ReadyFile != "" {
+		if err := writeFileAtomic(l.ReadyFile, []byte(time.Now().UTC().Format(time.RFC3339)+"\n")); err != nil {
+			log.Printf("[ERROR] Failed to write ready file %s: %v", l.ReadyFile, err)
+		}
+	}
+}
+
+// stopping withdraws readiness first, so no new traffic is routed here while we drain.
+func (l *lifecycle) stopping() {
+	if err := sdNotify("STOPPING=1"); err != nil {
+		log.Printf("[WARN] sd_notify STOPPING failed: %v", err)
+	}
+	if l.ReadyFile != "" {
+		os.Remove(l.ReadyFile)
+	}
+}
+
+func (l *lifecycle) stopped() {
+	if l.PIDFile != "" && l.claimed.Load() {
+		os.Remove(l.PIDFile)
+	}
+}
+
+// --- Main ---
+
+// resolveStoragePath prefers the Docker volume and falls back to the working directory.
+func resolveStoragePath() string {
+	// Ensure directory exists
+	if err := os.MkdirAll("/data", 0755); err != nil {
+		// Fallback for local run without docker volume mapping
+		log.Println("[WARN] Could not create /data, using current directory for storage")
+	}
+
+	if _, err := os.Stat("/data"); os.IsNotExist(err) {
+		return "conversationbot.json"
+	}
+	return StorageFile
+}
+
+// newStorageFromEnv picks single-file or sharded storage according to STORAGE_MODE.
+// readOnly (STORAGE_READ_ONLY) is applied before the first load.
+func newStorageFromEnv(readOnly bool) *ThreadSafeStorage {
+	compression := os.Getenv("STORAGE_COMPRESSION")
+	if compression != "" && compression != "gzip" {
+		log.Fatalf("Unknown STORAGE_COMPRESSION %q (want gzip or empty)", compression)
+	}
+
+	path := resolveStoragePath()
+	var storage *ThreadSafeStorage
+	switch os.Getenv("STORAGE_MODE") {
+	case "", "file":
+		storage = openStorage(&ThreadSafeStorage{FilePath: path, ReadOnly: readOnly})
+	case "sharded":
+		storage = openStorage(&ThreadSafeStorage{FilePath: path, ShardDir: filepath.Join(filepath.Dir(path), "sessions"), ReadOnly: readOnly})
+	default:
+		log.Fatalf("Unknown STORAGE_MODE %q (want file or sharded)", os.Getenv("STORAGE_MODE"))
+	}
+	// Loading auto-detects compression, so the setting only affects future writes.
+	storage.Compression = compression
+
+	var keyring *Keyring
+	if value := os.Getenv("STORAGE_MASTER_KEY"); value != "" {
+		master, err := parseMasterKey(value)
+		if err != nil {
+			log.Fatalf("Invalid STORAGE_MASTER_KEY: %v", err)
+		}
+		if keyring, err = NewKeyring(master, path+".keys"); err != nil {
+			log.Fatalf("Failed to load keyring: %v", err)
+		}
+		log.Println("[INFO] Per-user fact encryption enabled.")
+	}
+	storage.UseKeyring(keyring)
+	return storage
+}
+
+func main() {
+	log.SetOutput(logLevel)
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		level, err := parseLogLevel(raw)
+		if err != nil {
+			log.Fatalf("Invalid LOG_LEVEL: %v", err)
+		}
+		logLevel.min.Store(level)
+	}
+
+	stripEmojiFromKeys, _ = strconv.ParseBool(os.Getenv("KEY_STRIP_EMOJI"))
+	if err := loadQuotasFromEnv(); err != nil {
+		log.Fatalf("Invalid quota configuration: %v", err)
+	}
+	if err := loadValueNormalizationFromEnv(); err != nil {
+		log.Fatalf("Invalid value normalization: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "import-users" {
+		if err := runImportUsers(os.Args[2:]); err != nil {
+			log.Fatalf("import-users: %v", err)
+		}
+		return
+	}
+
+	force := flag.Bool("force", false, "start even if persisted data fails its integrity check")
+	flag.Parse()
+
+	if raw := os.Getenv("SHUTDOWN_TIMEOUT"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			log.Fatalf("SHUTDOWN_TIMEOUT must be a positive duration: %q", raw)
+		}
+		shutdownTimeout = d
+	}
+
+	token := os.Getenv("TELEGRAM_TOKEN")
+	if token == "" {
+		log.Fatal("TELEGRAM_TOKEN environment variable is required")
+	}
+
+	// Graceful shutdown: the loop finishes the update in flight, then saves and exits.
+	// If that takes longer than shutdownTimeout we exit anyway, losing the stuck update
+	// and, with a deferred SAVE_STRATEGY, whatever was not saved yet. The handler is
+	// registered before startup so a signal during the restart reminders still saves.
+	proc := &lifecycle{PIDFile: os.Getenv("PID_FILE"), ReadyFile: os.Getenv("READY_FILE")}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+
+	go func() {
+		sig := <-c
+		log.Printf("[INFO] %v received, finishing the current update...", sig)
+		proc.stopping()
+		close(stop)
+		time.Sleep(shutdownTimeout)
+		log.Printf("[ERROR] Shutdown did not finish within %s, exiting without a final save", shutdownTimeout)
+		proc.stopped()
+		os.Exit(1)
+	}()
+
+	// Initialize Storage. A replica must be read-only before its first load.
+	readOnly, _ := strconv.ParseBool(os.Getenv("STORAGE_READ_ONLY"))
+	storage := newStorageFromEnv(readOnly)
+	store = storage
+
+	if err := checkIntegrity(storage, *force); err != nil {
+		log.Fatalf("Not starting: %v", err)
+	}
+
+	saver, err := newSavePolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid save configuration: %v", err)
+	}
+	if saver.Strategy != SaveEveryUpdate {
+		log.Printf("[INFO] Saving storage with strategy %s (%s)", saver.Strategy, saver.Interval)
+	}
+
+	var reloadTick <-chan time.Time
+	if readOnly {
+		interval := 30 * time.Second
+		if raw := os.Getenv("STORAGE_RELOAD_INTERVAL"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d <= 0 {
+				log.Fatalf("STORAGE_RELOAD_INTERVAL must be a positive duration: %q", raw)
+			}
+			interval = d
+		}
+		log.Printf("[INFO] Storage is read-only, reloading from disk every %s", interval)
+		// Reloads run on the update loop, like saves, so handlers never see a half-loaded map.
+		reloadTick = time.NewTicker(interval).C
+	}
+
+	if raw := os.Getenv("ADMIN_CHAT_ID"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			log.Fatalf("ADMIN_CHAT_ID must be a numeric chat ID: %v", err)
+		}
+		adminChatID = id
+		log.Printf("[INFO] Admin chat: %d", adminChatID)
+	}
+
+	if raw := os.Getenv("HANDLER_BUDGET"); raw != "" {
+		budget, err := time.ParseDuration(raw)
+		if err != nil || budget <= 0 {
+			log.Fatalf("HANDLER_BUDGET must be a positive duration: %q", raw)
+		}
+		handlerBudget = budget
+	}
+
+	if raw := os.Getenv("GREETING_ABSENCE"); raw != "" {
+		absence, err := time.ParseDuration(raw)
+		if err != nil || absence <= 0 {
+			log.Fatalf("GREETING_ABSENCE must be a positive duration: %q", raw)
+		}
+		greetingAbsence = absence
+	}
+
+	// expvar registers /debug/vars on the default mux; /events is added next to it.
+	if token := os.Getenv("ADMIN_HTTP_TOKEN"); token != "" {
+		if os.Getenv("METRICS_ADDR") == "" {
+			log.Fatal("ADMIN_HTTP_TOKEN is set but METRICS_ADDR is not, so /events would never be served")
+		}
+		sessionEvents = NewSessionEventBroker(token)
+		http.Handle("/events", sessionEvents)
+		log.Println("[INFO] Session event stream enabled at /events")
+	}
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		go func() {
+			log.Printf("[INFO] Serving metrics on %s/debug/vars", addr)
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				log.Printf("[ERROR] Metrics server stopped: %v", err)
+			}
+		}()
+	}
+
+	// Aggregates are snapshotted on the update loop (handlers write sessions without locking).
+	var aggregates *aggregateExporter
+	var aggregateTick <-chan time.Time
+	if sink := os.Getenv("AGGREGATES_SINK"); sink != "" {
+		interval := 24 * time.Hour
+		if raw := os.Getenv("AGGREGATES_INTERVAL"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d <= 0 {
+				log.Fatalf("AGGREGATES_INTERVAL must be a positive duration: %q", raw)
+			}
+			interval = d
+		}
+		if raw := os.Getenv("AGGREGATES_MIN_USERS"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 {
+				log.Fatalf("AGGREGATES_MIN_USERS must be a positive integer: %q", raw)
+			}
+			aggregateMinUsers = n
+		}
+		log.Printf("[INFO] Exporting aggregate statistics to %s every %s", sink, interval)
+		aggregates = &aggregateExporter{sink: sink, client: &http.Client{Timeout: 10 * time.Second}}
+		aggregateTicker := time.NewTicker(interval)
+		aggregateTick = aggregateTicker.C
+		// The update loop has not started yet, so this first snapshot is safe here.
+		aggregates.Export(computeAggregates(storage.Sessions, time.Now()))
+	}
+
+	if path := os.Getenv("SCRIPTS_FILE"); path != "" {
+		loaded, err := LoadQuestionnaires(path)
+		if err != nil {
+			log.Fatalf("Invalid questionnaire scripts: %v", err)
+		}
+		questionnaires = loaded
+		log.Printf("[INFO] Loaded %d questionnaire(s) from %s", len(questionnaires), path)
+	}
+
+	obfuscator, err := newIDObfuscator(os.Getenv("ID_OBFUSCATION"), os.Getenv("ID_OBFUSCATION_SECRET"))
+	if err != nil {
+		log.Fatalf("Invalid ID obfuscation configuration: %v", err)
+	}
+	idObfuscator = obfuscator
+
+	if hook, err := newAnalyticsFromEnv(); err != nil {
+		log.Fatalf("Invalid analytics configuration: %v", err)
+	} else if hook != nil {
+		analytics = hook
+	}
+
+	// Initialize Bot
+	debug, _ := strconv.ParseBool(os.Getenv("TELEGRAM_DEBUG"))
+	telegramDebug.Store(debug)
+	bot, err := tgbotapi.NewBotAPIWithClient(token, tgbotapi.APIEndpoint, debugClient{&http.Client{}})
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("[INFO] Authorized on account %s", bot.Self.UserName)
+
+	if adminChatID != 0 {
+		for _, alert := range storage.TakeAlerts() {
+			send(bot, nil, tgbotapi.NewMessage(adminChatID, "⚠️ "+alert))
+		}
+	}
+
+	if !storage.ReadOnly && remindAfterRestart(storage, bot, stop) {
+		saver.Changed(storage)
+	}
+	// After a signal during startup the loop below only saves and exits.
+	shuttingDown := false
+	select {
+	case <-stop:
+		shuttingDown = true
+	default:
+	}
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+
+	// Telegram hands each update to one getUpdates poller only, so a read-only replica
+	// polling next to the primary would steal its traffic. The replica waits for SIGUSR1,
+	// sent once the primary has stopped, and then answers in its place until replaced.
+	var updates tgbotapi.UpdatesChannel
+	takeover := make(chan os.Signal, 1)
+	if storage.ReadOnly {
+		signal.Notify(takeover, syscall.SIGUSR1)
+		log.Println("[INFO] Read-only replica: not polling for updates until SIGUSR1")
+	} else if !shuttingDown {
+		updates = bot.GetUpdatesChan(u)
+	}
+	// Only a process that passed validation and is about to serve claims the PID file,
+	// so a failed start never overwrites the PID of an instance still running.
+	proc.started()
+	if updates != nil {
+		proc.ready()
+	}
+
+	// Main Loop
+	for {
+		var update tgbotapi.Update
+		select {
+		case <-stop:
+			bot.StopReceivingUpdates()
+			log.Println("[INFO] Saving storage before exit...")
+			saver.Flush(storage)
+			analytics.Close()
+			proc.stopped()
+			log.Println("[INFO] Shutdown complete.")
+			return
+		case <-saver.Due():
+			saver.Tick(storage)
+			continue
+		case <-aggregateTick:
+			aggregates.Export(computeAggregates(storage.Sessions, time.Now()))
+			continue
+		case <-reloadTick:
+			storage.Load()
+			// The primary may be in the middle of a save; just report.
+			for _, problem := range storage.IntegrityErrors() {
+				log.Printf("[WARN] Integrity check failed on reload: %s", problem)
+			}
+			continue
+		case <-takeover:
+			if updates == nil {
+				log.Println("[INFO] SIGUSR1 received, read-only replica now polling for updates")
+				updates = bot.GetUpdatesChan(u)
+				proc.ready()
+			}
+			continue
+		case update = <-updates:
+		}
+
+		if err := validateUpdate(update); err != nil {
+			if errors.Is(err, errUnsupportedUpdate) {
+				log.Printf("[DEBUG] Skipping update %d: %v", update.UpdateID, err)
+			} else {
+				quarantineUpdate(update, err)
+			}
+			continue
+		}
+
+		userID := update.Message.From.ID
+		session := storage.GetOrCreateSession(userID)
+
+		log.Printf("[UPDATE] User: %s (%d) | Text: %s | Current State: %d", update.Message.From.UserName, userID, update.Message.Text, session.State)
+
+		fromState := session.State
+		ProcessUpdate(update, session, bot)
+
+		if sessionEvents != nil {
+			sessionEvents.Publish(SessionEvent{
+				UserID:    idObfuscator.Obfuscate(userID),
+				UpdateID:  update.UpdateID,
+				FromState: stateName(fromState),
+				State:     stateName(session.State),
+				Facts:     len(session.UserData),
+				Time:      time.Now().UTC().Format(time.RFC3339),
+			})
+		}
+
+		saver.Changed(storage)
+	}
+}
@@ -1,7 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"image/png"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -10,7 +29,7 @@ import (
 // However, we can test the Logic Helper functions and Storage persistence.
 
 func TestStoragePersistence(t *testing.T) {
-	tmpFile := "test_storage.json"
+	tmpFile := filepath.Join(t.TempDir(), "test_storage.json")
 	storage := NewStorage(tmpFile)
 
 	userID := int64(12345)
@@ -64,6 +83,1522 @@ func makeMessageUpdate(text string) tgbotapi.Update {
 	}
 }
 
+// makeCommandUpdate builds an update whose text is recognised as a bot command.
+func makeCommandUpdate(text string) tgbotapi.Update {
+	update := makeMessageUpdate(text)
+	command, _, _ := strings.Cut(text, " ")
+	update.Message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+	return update
+}
+
 // Note: Testing ProcessUpdate fully requires mocking the tgbotapi.BotAPI which performs network calls.
 // In a real generic architecture, we would wrap BotAPI in an interface (Sender).
 // For this strict single-file task, we focused on testing the State/Storage logic.
+
+func TestProcessUpdateSkipsReplayedUpdate(t *testing.T) {
+	session := &UserSession{
+		State:            StateChoosing,
+		UserData:         make(map[string]string),
+		AppliedUpdateIDs: []int{9, 10, 11},
+	}
+
+	update := makeMessageUpdate("Age")
+	update.UpdateID = 10
+
+	// A replayed update must return before touching the bot, so a nil bot is safe here.
+	ProcessUpdate(update, session, nil)
+
+	if session.State != StateChoosing || session.CurrentKey != "" {
+		t.Errorf("Replayed update changed the session: state %d, key %q", session.State, session.CurrentKey)
+	}
+}
+
+func TestProcessUpdateAcceptsLowerUnseenUpdate(t *testing.T) {
+	bot, _ := newFakeBot(t)
+	guard = NewRateGuard()
+	// update_ids restart lower after the bot is re-created; an unseen one must still apply.
+	session := &UserSession{
+		State:            StateChoosing,
+		UserData:         make(map[string]string),
+		AppliedUpdateIDs: []int{500},
+	}
+
+	update := makeMessageUpdate("Age")
+	update.UpdateID = 7
+	ProcessUpdate(update, session, bot)
+
+	if session.State != StateTypingReply || session.CurrentKey != "age" {
+		t.Errorf("Lower unseen update was dropped: state %d, key %q", session.State, session.CurrentKey)
+	}
+
+	for id := 1; id <= appliedUpdateWindow+5; id++ {
+		session.recordUpdate(id)
+	}
+	if len(session.AppliedUpdateIDs) != appliedUpdateWindow || session.appliedUpdate(1) {
+		t.Errorf("Applied update window not bounded: %v", session.AppliedUpdateIDs)
+	}
+}
+
+func TestRenderCard(t *testing.T) {
+	data, err := renderCard("Test User", map[string]string{
+		"age":              "30",
+		"favourite colour": strings.Repeat("very long value ", 10),
+	})
+	if err != nil {
+		t.Fatalf("renderCard failed: %v", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Card is not a valid PNG: %v", err)
+	}
+	if img.Bounds().Dx() != cardWidth {
+		t.Errorf("Expected card width %d, got %d", cardWidth, img.Bounds().Dx())
+	}
+	for _, r := range "Жёлтый" {
+		if index, err := cardFont.GlyphIndex(nil, r); err != nil || index == 0 {
+			t.Errorf("Card font has no glyph for %q", r)
+		}
+	}
+}
+
+func TestParseAdminReply(t *testing.T) {
+	userID, text, err := parseAdminReply("reply 42 Thanks for the report!")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if userID != 42 || text != "Thanks for the report!" {
+		t.Errorf("Got user %d, text %q", userID, text)
+	}
+
+	for _, args := range []string{"reply", "reply 42", "reply abc hello"} {
+		if _, _, err := parseAdminReply(args); err == nil {
+			t.Errorf("Expected error for %q", args)
+		}
+	}
+}
+
+func TestStorageTickets(t *testing.T) {
+	storage := &ThreadSafeStorage{Sessions: map[int64]*UserSession{
+		7: {Tickets: []*Ticket{
+			{ID: "7-1", Status: TicketClosed, CreatedAt: 1},
+			{ID: "7-2", Status: TicketOpen, CreatedAt: 3},
+		}},
+		8: {Tickets: []*Ticket{{ID: "8-1", Status: TicketOpen, CreatedAt: 2}}},
+	}}
+
+	userID, ticket := storage.FindTicket("7-2")
+	if ticket == nil || userID != 7 {
+		t.Fatalf("Expected ticket 7-2 owned by 7, got %v owned by %d", ticket, userID)
+	}
+	if _, ticket := storage.FindTicket("9-1"); ticket != nil {
+		t.Errorf("Expected no ticket for unknown user, got %v", ticket)
+	}
+
+	open := storage.OpenTickets()
+	if len(open) != 2 || open[0].ID != "8-1" || open[1].ID != "7-2" {
+		t.Errorf("Unexpected open tickets: %v", open)
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	if err := validateUpdate(makeMessageUpdate("Age")); err != nil {
+		t.Errorf("Valid update rejected: %v", err)
+	}
+
+	if err := validateUpdate(tgbotapi.Update{UpdateID: 1}); !errors.Is(err, errUnsupportedUpdate) {
+		t.Errorf("Expected errUnsupportedUpdate, got %v", err)
+	}
+
+	noSender := makeMessageUpdate("Age")
+	noSender.Message.From = nil
+	noChat := makeMessageUpdate("Age")
+	noChat.Message.Chat = nil
+	tooLong := makeMessageUpdate(strings.Repeat("a", maxMessageTextBytes+1))
+
+	for name, update := range map[string]tgbotapi.Update{"no sender": noSender, "no chat": noChat, "too long": tooLong} {
+		err := validateUpdate(update)
+		if err == nil || errors.Is(err, errUnsupportedUpdate) {
+			t.Errorf("%s: expected a validation error, got %v", name, err)
+		}
+	}
+}
+
+func TestBatchExporterPostHog(t *testing.T) {
+	var mu sync.Mutex
+	var received []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Invalid payload: %v", err)
+		}
+		mu.Lock()
+		received = append(received, payload)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	exporter := NewBatchExporter(server.URL, posthogEncoder("key"), 2, time.Hour)
+	for i := 0; i < 3; i++ {
+		exporter.Track(AnalyticsEvent{Name: EventFactSaved, DistinctID: "42", Time: time.Now()})
+	}
+	exporter.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("Expected a full batch and a final flush, got %d requests", len(received))
+	}
+	if received[0]["api_key"] != "key" {
+		t.Errorf("Expected api_key 'key', got %v", received[0]["api_key"])
+	}
+	batch := received[0]["batch"].([]interface{})
+	first := batch[0].(map[string]interface{})
+	if len(batch) != 2 || first["event"] != EventFactSaved || first["distinct_id"] != "42" {
+		t.Errorf("Unexpected first batch: %v", batch)
+	}
+}
+
+// mapCount reads one counter of an expvar map. The maps are global, so tests compare
+// before and after values rather than absolute ones.
+func mapCount(m *expvar.Map, key string) int64 {
+	if count, ok := m.Get(key).(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+func TestObserveHandlerCountsSlowCalls(t *testing.T) {
+	update := makeMessageUpdate("Age")
+	before := mapCount(handlerSlow, "test_handler")
+
+	observeHandler("test_handler", handlerBudget/2, &update)
+	if mapCount(handlerSlow, "test_handler") != before {
+		t.Error("Fast handler should not be counted as slow")
+	}
+
+	observeHandler("test_handler", handlerBudget*2, &update)
+	if got := mapCount(handlerSlow, "test_handler") - before; got != 1 {
+		t.Errorf("Expected one slow call, got %d", got)
+	}
+}
+
+func TestClassifySendError(t *testing.T) {
+	cases := map[string]struct {
+		err  error
+		kind SendErrorKind
+	}{
+		"blocked":      {&tgbotapi.Error{Code: 403, Message: "Forbidden: bot was blocked by the user"}, SendBlocked},
+		"rate limited": {&tgbotapi.Error{Code: 429, Message: "Too Many Requests"}, SendTransient},
+		"server error": {&tgbotapi.Error{Code: 502, Message: "Bad Gateway"}, SendTransient},
+		"bad request":  {&tgbotapi.Error{Code: 400, Message: "Bad Request: chat not found"}, SendPermanent},
+		"network":      {errors.New("connection reset by peer"), SendTransient},
+	}
+	for name, tc := range cases {
+		sendErr := classifySendError(1, tc.err)
+		if sendErr.Kind != tc.kind {
+			t.Errorf("%s: expected %s, got %s", name, tc.kind, sendErr.Kind)
+		}
+		if !errors.Is(sendErr, tc.err) {
+			t.Errorf("%s: SendError should wrap the original error", name)
+		}
+	}
+}
+
+func TestSendErrorRedactsToken(t *testing.T) {
+	reset := errors.New("connection reset by peer")
+	err := &url.Error{Op: "Post", URL: "https://api.telegram.org/bot123:SECRET/sendMessage", Err: reset}
+	sendErr := classifySendError(1, err)
+	if strings.Contains(sendErr.Error(), "SECRET") || !strings.Contains(sendErr.Error(), "sendMessage") {
+		t.Errorf("Expected the token redacted from %q", sendErr.Error())
+	}
+	if sendErr.Kind != SendTransient || !errors.Is(sendErr, reset) {
+		t.Errorf("Expected a transient error wrapping the cause, got %v", sendErr)
+	}
+}
+
+func TestSendSkipsBlockedSession(t *testing.T) {
+	session := &UserSession{Blocked: true}
+	// A blocked session must short-circuit before the bot is used.
+	if err := send(nil, session, tgbotapi.NewMessage(1, "hello")); !errors.Is(err, errRecipientBlocked) {
+		t.Errorf("Expected errRecipientBlocked, got %v", err)
+	}
+}
+
+func TestProcessUpdateClearsBlockedFlag(t *testing.T) {
+	session := &UserSession{State: StateChoosing, UserData: make(map[string]string), Blocked: true}
+
+	// Unrecognised text in CHOOSING is only logged, so no bot is needed.
+	ProcessUpdate(makeMessageUpdate("hello again"), session, nil)
+
+	if session.Blocked {
+		t.Error("Expected blocked flag to be cleared after the user wrote")
+	}
+}
+
+func TestLoadQuestionnaires(t *testing.T) {
+	loaded, err := LoadQuestionnaires("questionnaires.example.json")
+	if err != nil {
+		t.Fatalf("Example script failed to load: %v", err)
+	}
+	quiz, ok := loaded["quiz"]
+	if !ok || len(quiz.Questions) != 4 {
+		t.Fatalf("Expected /quiz with 4 questions, got %v", loaded)
+	}
+	age := quiz.Questions[1]
+	if age.pattern == nil || !age.pattern.MatchString("27") || age.pattern.MatchString("27 years") {
+		t.Error("Validate pattern should match the whole answer")
+	}
+
+	invalid := map[string]string{
+		"no command":    `{"questionnaires": [{"questions": [{"key": "a", "prompt": "A?"}]}]}`,
+		"builtin":       `{"questionnaires": [{"command": "start", "questions": [{"key": "a", "prompt": "A?"}]}]}`,
+		"no questions":  `{"questionnaires": [{"command": "q"}]}`,
+		"no prompt":     `{"questionnaires": [{"command": "q", "questions": [{"key": "a"}]}]}`,
+		"bad pattern":   `{"questionnaires": [{"command": "q", "questions": [{"key": "a", "prompt": "A?", "validate": "("}]}]}`,
+		"unknown goto":  `{"questionnaires": [{"command": "q", "questions": [{"key": "a", "prompt": "A?", "next": [{"goto": "zzz"}]}]}]}`,
+		"bad op":        `{"questionnaires": [{"command": "q", "questions": [{"key": "a", "prompt": "A?", "next": [{"if": {"key": "a", "op": "like"}, "goto": "end"}]}]}]}`,
+		"loop":          `{"questionnaires": [{"command": "q", "questions": [{"key": "a", "prompt": "A?"}, {"key": "b", "prompt": "B?", "next": [{"if": {"key": "b", "op": "eq", "value": "x"}, "goto": "a"}]}]}]}`,
+		"unreachable":   `{"questionnaires": [{"command": "q", "questions": [{"key": "a", "prompt": "A?", "next": [{"goto": "c"}]}, {"key": "b", "prompt": "B?"}, {"key": "c", "prompt": "C?"}]}]}`,
+		"duplicate cmd": `{"questionnaires": [{"command": "q", "questions": [{"key": "a", "prompt": "A?"}]}, {"command": "q", "questions": [{"key": "a", "prompt": "A?"}]}]}`,
+	}
+	for name, script := range invalid {
+		if _, err := ParseQuestionnaires([]byte(script)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestQuestionnaireBranching(t *testing.T) {
+	loaded, err := LoadQuestionnaires("questionnaires.example.json")
+	if err != nil {
+		t.Fatalf("Example script failed to load: %v", err)
+	}
+	quiz := loaded["quiz"]
+	age, occupation, city := quiz.index["age"], quiz.index["occupation"], quiz.index["city"]
+
+	if next := quiz.nextQuestion(age, map[string]string{"age": "15"}); next != city {
+		t.Errorf("Minors should skip to city, got question %d", next)
+	}
+	if next := quiz.nextQuestion(age, map[string]string{"age": "30"}); next != occupation {
+		t.Errorf("Adults should be asked about occupation, got question %d", next)
+	}
+	if next := quiz.nextQuestion(city, nil); next != len(quiz.Questions) {
+		t.Errorf("Last question should finish the questionnaire, got %d", next)
+	}
+}
+
+func TestConversationStack(t *testing.T) {
+	session := &UserSession{State: StateTypingReply, CurrentKey: "age", UserData: make(map[string]string)}
+
+	session.Suspend()
+	if session.State != StateChoosing || session.CurrentKey != "" || len(session.Suspended) != 1 {
+		t.Fatalf("Suspend should push the active conversation and reset, got %+v", session)
+	}
+
+	// An interrupting questionnaire is itself interrupted by feedback.
+	session.State, session.Questionnaire, session.QuestionIndex = StateQuestionnaire, "quiz", 2
+	session.Suspend()
+	session.State = StateTypingFeedback
+
+	if !session.Resume() || session.State != StateQuestionnaire || session.Questionnaire != "quiz" || session.QuestionIndex != 2 {
+		t.Fatalf("Expected to resume the questionnaire, got %+v", session)
+	}
+	if !session.Resume() || session.State != StateTypingReply || session.CurrentKey != "age" || session.Questionnaire != "" {
+		t.Fatalf("Expected to resume the fact conversation, got %+v", session)
+	}
+	if session.Resume() || session.State != StateChoosing {
+		t.Errorf("Empty stack should leave the session at the main menu, got %+v", session)
+	}
+
+	// Idle sessions have nothing to resume.
+	session.Suspend()
+	if len(session.Suspended) != 0 {
+		t.Errorf("Suspending an idle session should not push anything, got %v", session.Suspended)
+	}
+}
+
+func TestReadOnlyStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	storage := &ThreadSafeStorage{Sessions: make(map[int64]*UserSession), FilePath: path, ReadOnly: true}
+	storage.GetOrCreateSession(1)
+	storage.Save()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Read-only storage should not write to disk, stat error: %v", err)
+	}
+
+	if mutatesSession(makeCommandUpdate("/show_data")) {
+		t.Error("/show_data should be allowed in read-only mode")
+	}
+	if !mutatesSession(makeMessageUpdate("Age")) {
+		t.Error("Choosing a category should be rejected in read-only mode")
+	}
+}
+
+func TestIDObfuscation(t *testing.T) {
+	secret := "0123456789abcdef"
+	for _, mode := range []string{"hash", "token"} {
+		obfuscator, err := newIDObfuscator(mode, secret)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		id := obfuscator.Obfuscate(12345)
+		if strings.Contains(id, "12345") {
+			t.Errorf("%s: raw ID leaked in %q", mode, id)
+		}
+		if id != obfuscator.Obfuscate(12345) || id == obfuscator.Obfuscate(12346) {
+			t.Errorf("%s: expected a stable, per-user identifier", mode)
+		}
+
+		other, _ := newIDObfuscator(mode, "another-secret-value")
+		if other.Obfuscate(12345) == id {
+			t.Errorf("%s: different secrets should give different identifiers", mode)
+		}
+	}
+
+	if _, err := newIDObfuscator("hash", "short"); err == nil {
+		t.Error("Expected an error for a short secret")
+	}
+	if plain, _ := newIDObfuscator("", ""); plain.Obfuscate(42) != "42" {
+		t.Error("Default mode should pass IDs through")
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	csvData := "user_id, Age, Favourite colour\n101, 30, Blue\n102, , green\n"
+	rows, err := parseImportCSV(strings.NewReader(csvData))
+	if err != nil {
+		t.Fatalf("parseImportCSV failed: %v", err)
+	}
+	if len(rows) != 2 || rows[0].UserID != 101 || rows[0].Facts["favourite colour"] != "Blue" {
+		t.Fatalf("Unexpected rows: %+v", rows)
+	}
+	if _, ok := rows[1].Facts["age"]; ok {
+		t.Error("Empty cells should be skipped")
+	}
+
+	storage := &ThreadSafeStorage{Sessions: make(map[int64]*UserSession)}
+	storage.GetOrCreateSession(101).UserData["age"] = "31"
+
+	if added := seedSession(storage, rows[0]); added != 1 {
+		t.Errorf("Expected 1 new fact, got %d", added)
+	}
+	if got := storage.GetSession(101).UserData["age"]; got != "31" {
+		t.Errorf("Import must not overwrite facts the user gave, got age %q", got)
+	}
+	if added := seedSession(storage, rows[0]); added != 0 {
+		t.Errorf("Re-running the import should add nothing, added %d", added)
+	}
+
+	for _, bad := range []string{"id,age\n1,2\n", "user_id,age\nabc,2\n"} {
+		if _, err := parseImportCSV(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestSessionEventStream(t *testing.T) {
+	broker := NewSessionEventBroker("secret")
+	server := httptest.NewServer(broker)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 with a token, got %d", resp.StatusCode)
+	}
+
+	// The subscriber is registered before the headers are flushed, so this is delivered.
+	broker.Publish(SessionEvent{UserID: "7", State: stateName(StateTypingReply), Facts: 2})
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended before an event arrived: %v", err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			var event SessionEvent
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatalf("Invalid event payload %q: %v", line, err)
+			}
+			if event.UserID != "7" || event.State != "typing_reply" || event.Facts != 2 {
+				t.Errorf("Unexpected event: %+v", event)
+			}
+			return
+		}
+	}
+}
+
+func TestRateGuard(t *testing.T) {
+	g := NewRateGuard()
+	clock := time.Unix(1000, 0)
+	g.now = func() time.Time { return clock }
+
+	if reason := g.Check(makeMessageUpdate("Age")); reason != "" {
+		t.Fatalf("First message suppressed: %s", reason)
+	}
+	if reason := g.Check(makeMessageUpdate("Age")); reason == "" {
+		t.Error("Immediate identical message should be suppressed as a double tap")
+	}
+	clock = clock.Add(duplicateWindow)
+	if reason := g.Check(makeMessageUpdate("Age")); reason != "" {
+		t.Errorf("Identical message after the window should pass, got %s", reason)
+	}
+
+	clock = clock.Add(time.Minute)
+	if reason := g.Check(makeCommandUpdate("/show_data")); reason != "" {
+		t.Fatalf("First /show_data suppressed: %s", reason)
+	}
+	g.Check(makeMessageUpdate("something in between"))
+	clock = clock.Add(time.Second)
+	if reason := g.Check(makeCommandUpdate("/show_data")); reason == "" {
+		t.Error("/show_data within its cooldown should be suppressed")
+	}
+	clock = clock.Add(commandCooldowns["show_data"])
+	if reason := g.Check(makeCommandUpdate("/show_data")); reason != "" {
+		t.Errorf("/show_data after its cooldown should pass, got %s", reason)
+	}
+
+	g.lastMessages[99] = lastMessage{Text: "hi", At: clock}
+	g.lastCommands[99] = map[string]time.Time{"card": clock}
+	clock = clock.Add(time.Hour)
+	g.Check(makeMessageUpdate("Age"))
+	if _, ok := g.lastMessages[99]; ok || g.lastCommands[99] != nil || len(g.lastCommands) != 0 {
+		t.Errorf("Expired entries should be swept, got %v and %v", g.lastMessages, g.lastCommands)
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	cases := map[string]string{
+		"Favourite colour":             "favourite colour",
+		"  Most   impressive\tskill  ": "most impressive skill",
+		"Sk\u200bill":                  "skill",
+		"Cafe\u0301":                   "caf\u00e9", // Decomposed é becomes NFC
+		"Pet 🐶":                        "pet 🐶",
+	}
+	for in, want := range cases {
+		if got := normalizeKey(in); got != want {
+			t.Errorf("normalizeKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	stripEmojiFromKeys = true
+	defer func() { stripEmojiFromKeys = false }()
+	if got := normalizeKey("🐶 Pet 👍🏽"); got != "pet" {
+		t.Errorf("Expected emoji to be stripped, got %q", got)
+	}
+}
+
+func TestNormalizeSessionKeysMergesDuplicates(t *testing.T) {
+	session := &UserSession{
+		UserData:      map[string]string{"Pet ": "cat", "pet": "dog", "age": "30"},
+		FactUpdateIDs: map[string]int{"Pet ": 5, "pet": 9},
+	}
+	normalizeSessionFacts(session)
+
+	if len(session.UserData) != 2 || session.UserData["pet"] != "dog" || session.UserData["age"] != "30" {
+		t.Errorf("Expected the newest duplicate to win, got %v", session.UserData)
+	}
+	if session.FactUpdateIDs["pet"] != 9 {
+		t.Errorf("Expected pet update_id 9, got %d", session.FactUpdateIDs["pet"])
+	}
+}
+
+func TestSetFactQuotas(t *testing.T) {
+	saved := quotas
+	defer func() { quotas = saved }()
+	quotas = Quotas{MaxCategories: 2, MaxValueRunes: 5, MaxSessionBytes: 200}
+
+	session := &UserSession{UserData: make(map[string]string)}
+	var quotaErr *QuotaError
+
+	if err := setFact(session, "age", "30", 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := setFact(session, "colour", "зелёный", 2); !errors.As(err, &quotaErr) {
+		t.Errorf("Expected value length quota error, got %v", err)
+	}
+	if err := setFact(session, "colour", "blue", 3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := setFact(session, "pet", "cat", 4); !errors.As(err, &quotaErr) {
+		t.Errorf("Expected category quota error, got %v", err)
+	}
+	if err := setFact(session, "age", "31", 5); err != nil {
+		t.Errorf("Updating an existing category should be allowed, got %v", err)
+	}
+
+	quotas.MaxSessionBytes = 10
+	if err := setFact(session, "age", "32", 6); !errors.As(err, &quotaErr) {
+		t.Errorf("Expected session size quota error, got %v", err)
+	}
+	if session.UserData["age"] != "31" || session.FactUpdateIDs["age"] != 5 {
+		t.Errorf("Rejected write should leave the fact untouched, got %q (update %d)", session.UserData["age"], session.FactUpdateIDs["age"])
+	}
+
+	// Only facts count towards the size quota; tickets are limited separately.
+	quotas = Quotas{MaxSessionBytes: 200, MaxOpenTickets: 1, MaxTicketRunes: 5}
+	session.Tickets = []*Ticket{{ID: "1-1", Text: strings.Repeat("x", 500), Status: TicketClosed}}
+	if err := setFact(session, "age", "33", 7); err != nil {
+		t.Errorf("Tickets should not count towards the fact quota, got %v", err)
+	}
+	if err := checkTicketQuota(session, "hello"); err != nil {
+		t.Errorf("Closed tickets should not count as open, got %v", err)
+	}
+	if err := checkTicketQuota(session, "hello!"); !errors.As(err, &quotaErr) {
+		t.Errorf("Expected ticket length quota error, got %v", err)
+	}
+	session.Tickets = append(session.Tickets, &Ticket{ID: "1-2", Status: TicketOpen})
+	if err := checkTicketQuota(session, ""); !errors.As(err, &quotaErr) {
+		t.Errorf("Expected open ticket quota error, got %v", err)
+	}
+}
+
+func TestShardedStorage(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, "conversationbot.json")
+	if err := os.WriteFile(legacy, []byte(`{"1": {"state": 0, "user_data": {"age": "30"}}, "2": {"state": 0, "user_data": {"age": "40"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	shards := filepath.Join(dir, "sessions")
+
+	storage := NewShardedStorage(shards, legacy)
+	if _, err := os.Stat(legacy + ".migrated"); err != nil {
+		t.Errorf("Legacy file should be renamed after migration: %v", err)
+	}
+	if len(storage.Sessions) != 2 {
+		t.Fatalf("Expected 2 migrated sessions, got %d", len(storage.Sessions))
+	}
+
+	// Only the changed user's shard is rewritten.
+	untouched := filepath.Join(shards, "2.json")
+	before, _ := os.Stat(untouched)
+	storage.GetSession(1).UserData["age"] = "31"
+	time.Sleep(10 * time.Millisecond)
+	storage.Save()
+	if after, _ := os.Stat(untouched); !after.ModTime().Equal(before.ModTime()) {
+		t.Error("Saving user 1 should not rewrite user 2's shard")
+	}
+
+	// A corrupted shard does not take out the others.
+	if err := os.WriteFile(untouched, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := NewShardedStorage(shards, legacy)
+	if got := reloaded.GetSession(1); got == nil || got.UserData["age"] != "31" {
+		t.Errorf("Expected user 1 to survive a corrupt neighbour, got %+v", got)
+	}
+	if reloaded.GetSession(2) != nil {
+		t.Error("Corrupt shard should not be loaded")
+	}
+}
+
+func TestReadOnlyLoadLeavesFilesAlone(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, "conversationbot.json")
+	if err := os.WriteFile(legacy, []byte(`{"1": {"state": 0, "user_data": {"age": "30"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	shards := filepath.Join(dir, "sessions")
+	listing := func() []string {
+		var names []string
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			names = append(names, path)
+			return nil
+		})
+		return names
+	}
+
+	// No shards yet: the replica serves the legacy file without migrating it.
+	before := listing()
+	replica := openStorage(&ThreadSafeStorage{FilePath: legacy, ShardDir: shards, ReadOnly: true})
+	if got := replica.GetSession(1); got == nil || got.UserData["age"] != "30" {
+		t.Errorf("Replica should read the unmigrated file, got %+v", got)
+	}
+	if after := listing(); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Errorf("Read-only load changed the directory:\nbefore %v\nafter  %v", before, after)
+	}
+
+	// A corrupt shard stays where it is, and so does a corrupt single file.
+	NewShardedStorage(shards, legacy)
+	os.WriteFile(filepath.Join(shards, "5.json"), []byte("{not json"), 0644)
+	file := filepath.Join(dir, "single.json")
+	os.WriteFile(file, []byte(`{"1": {"state": 0`), 0644)
+	before = listing()
+	openStorage(&ThreadSafeStorage{FilePath: legacy, ShardDir: shards, ReadOnly: true})
+	openStorage(&ThreadSafeStorage{FilePath: file, ReadOnly: true})
+	if after := listing(); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Errorf("Read-only load changed the directory:\nbefore %v\nafter  %v", before, after)
+	}
+}
+
+func TestLoadRecoversCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	// Session 2 has a wrong type and the document is truncated inside session 4.
+	corrupt := `{"1": {"state": 0, "user_data": {"age": "30"}}, "2": {"state": "oops"}, "3": {"state": 1, "user_data": {}}, "4": {"state": 0, "user_d`
+	if err := os.WriteFile(path, []byte(corrupt), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := NewStorage(path)
+
+	if len(storage.Sessions) != 2 || storage.GetSession(1) == nil || storage.GetSession(3) == nil {
+		t.Errorf("Expected sessions 1 and 3 to be recovered, got %v", storage.Sessions)
+	}
+	matches, _ := filepath.Glob(path + ".corrupt-*")
+	if len(matches) != 1 {
+		t.Fatalf("Expected one quarantine copy, found %v", matches)
+	}
+	if kept, _ := os.ReadFile(matches[0]); string(kept) != corrupt {
+		t.Error("Quarantine copy should hold the original bytes")
+	}
+	if alerts := storage.TakeAlerts(); len(alerts) != 1 || !strings.Contains(alerts[0], "recovered 2 session(s), 2 unreadable") {
+		t.Errorf("Unexpected alerts: %v", alerts)
+	}
+	if storage.ReadOnly {
+		t.Error("Storage should stay writable once the original is quarantined")
+	}
+}
+
+func TestStorageChecksums(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "storage.json")
+
+	storage := NewStorage(path)
+	storage.GetOrCreateSession(1).UserData["age"] = "30"
+	storage.Save()
+
+	if problems := NewStorage(path).IntegrityErrors(); len(problems) != 0 {
+		t.Fatalf("Freshly saved file should verify, got %v", problems)
+	}
+
+	// A crash between the data and checksum renames must leave a file that verifies.
+	defer func() { faults.StorageWrite = nil }()
+	checksumWrites := 0
+	for _, crashAt := range []string{"data", "checksum"} {
+		checksumWrites = 0
+		faults.StorageWrite = func(target string) error {
+			if target == checksumPath(path) {
+				checksumWrites++
+			}
+			if (crashAt == "data" && target == path) || (crashAt == "checksum" && checksumWrites == 2) {
+				return errors.New("simulated crash")
+			}
+			return nil
+		}
+		storage.GetOrCreateSession(1).UserData["age"] = "crash before " + crashAt
+		storage.Save()
+		if problems := NewStorage(path).IntegrityErrors(); len(problems) != 0 {
+			t.Errorf("Crash before the %s rename should still verify, got %v", crashAt, problems)
+		}
+	}
+	faults.StorageWrite = nil
+	storage.GetOrCreateSession(1).UserData["age"] = "30"
+	storage.Save()
+	if err := checkIntegrity(NewStorage(path), false); err != nil {
+		t.Errorf("Expected a clean integrity check, got %v", err)
+	}
+
+	// Silent corruption that still parses as JSON.
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, bytes.Replace(data, []byte(`"30"`), []byte(`"31"`), 1), 0644)
+	if problems := NewStorage(path).IntegrityErrors(); len(problems) != 1 {
+		t.Errorf("Expected a checksum mismatch, got %v", problems)
+	}
+	if checkIntegrity(NewStorage(path), false) == nil || checkIntegrity(NewStorage(path), true) != nil {
+		t.Error("Integrity errors should be fatal unless forced")
+	}
+
+	shards := filepath.Join(dir, "sessions")
+	sharded := NewShardedStorage(shards, filepath.Join(dir, "none.json"))
+	sharded.GetOrCreateSession(5).UserData["age"] = "50"
+	sharded.GetOrCreateSession(6).UserData["age"] = "60"
+	sharded.Save()
+	if problems := NewShardedStorage(shards, "").IntegrityErrors(); len(problems) != 0 {
+		t.Fatalf("Freshly saved shards should verify, got %v", problems)
+	}
+
+	// Same for a crash after the manifest lists the new sums but before the shard is written.
+	faults.StorageWrite = func(target string) error {
+		if target == filepath.Join(shards, "5.json") {
+			return errors.New("simulated crash")
+		}
+		return nil
+	}
+	sharded.GetOrCreateSession(5).UserData["age"] = "55"
+	sharded.GetOrCreateSession(7).UserData["age"] = "70"
+	sharded.Save()
+	faults.StorageWrite = nil
+	if problems := NewShardedStorage(shards, "").IntegrityErrors(); len(problems) != 0 {
+		t.Fatalf("Interrupted shard save should still verify, got %v", problems)
+	}
+
+	os.WriteFile(filepath.Join(shards, "5.json"), []byte(`{"state": 0, "user_data": {"age": "51"}}`), 0644)
+	os.Remove(filepath.Join(shards, "6.json"))
+	if problems := NewShardedStorage(shards, "").IntegrityErrors(); len(problems) != 2 {
+		t.Errorf("Expected a mismatched and a missing shard, got %v", problems)
+	}
+}
+
+func TestStorageCompression(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "storage.json")
+
+	storage := NewStorage(path)
+	storage.Compression = "gzip"
+	storage.GetOrCreateSession(1).UserData["age"] = "30"
+	storage.Save()
+
+	data, _ := os.ReadFile(path)
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Fatal("Expected a gzip file on disk")
+	}
+	// Reading detects gzip without being told.
+	reloaded := NewStorage(path)
+	if len(reloaded.IntegrityErrors()) != 0 {
+		t.Errorf("Compressed file should verify: %v", reloaded.IntegrityErrors())
+	}
+	if got := reloaded.GetSession(1); got == nil || got.UserData["age"] != "30" {
+		t.Fatalf("Expected session to round-trip, got %+v", got)
+	}
+
+	// Switching back writes plain JSON again.
+	reloaded.Save()
+	if data, _ := os.ReadFile(path); data[0] != '{' {
+		t.Error("Uncompressed storage should write plain JSON")
+	}
+
+	shards := filepath.Join(dir, "sessions")
+	sharded := NewShardedStorage(shards, "")
+	sharded.Compression = "gzip"
+	sharded.GetOrCreateSession(5).UserData["age"] = "50"
+	sharded.Save()
+	before, _ := os.Stat(filepath.Join(shards, "5.json"))
+	time.Sleep(10 * time.Millisecond)
+	sharded.Save()
+	if after, _ := os.Stat(filepath.Join(shards, "5.json")); !after.ModTime().Equal(before.ModTime()) {
+		t.Error("Unchanged compressed shard should not be rewritten")
+	}
+	if got := NewShardedStorage(shards, "").GetSession(5); got == nil || got.UserData["age"] != "50" {
+		t.Errorf("Expected compressed shard to load, got %+v", got)
+	}
+}
+
+func TestEnvelopeEncryption(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "storage.json")
+	master := bytes.Repeat([]byte{7}, 32)
+	open := func() *ThreadSafeStorage {
+		keyring, err := NewKeyring(master, path+".keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage := NewStorage(path)
+		storage.UseKeyring(keyring)
+		return storage
+	}
+
+	storage := open()
+	replica := open()
+	replica.ReadOnly = true
+	storage.GetOrCreateSession(1).UserData["age"] = "30"
+	storage.GetOrCreateSession(1).FactUpdateIDs = map[string]int{"age": 3}
+	storage.GetOrCreateSession(2).UserData["age"] = "40"
+	storage.GetOrCreateSession(2).CurrentKey = "favourite colour"
+	storage.Save()
+
+	if data, _ := os.ReadFile(path); bytes.Contains(data, []byte(`"30"`)) || bytes.Contains(data, []byte("age")) || bytes.Contains(data, []byte("colour")) {
+		t.Fatalf("Facts and their categories should not be stored in plain text: %s", data)
+	}
+	reloaded := open()
+	if got := reloaded.GetSession(1); got == nil || got.UserData["age"] != "30" || got.FactUpdateIDs["age"] != 3 || got.SealedData != "" {
+		t.Fatalf("Expected facts to decrypt, got %+v", got)
+	}
+	if got := reloaded.GetSession(2); got.CurrentKey != "favourite colour" {
+		t.Errorf("Expected the pending category to decrypt, got %q", got.CurrentKey)
+	}
+
+	// A read-only replica picks up keys the primary created after it started.
+	replica.Load()
+	if got := replica.GetSession(1); got == nil || got.UserData["age"] != "30" {
+		t.Errorf("Replica should open facts after reloading the keyring, got %+v (%v)", got, replica.IntegrityErrors())
+	}
+
+	// A keyring without the key (and no tombstone) must not be taken as an erasure.
+	stale, _ := NewKeyring(master, filepath.Join(dir, "stale.keys"))
+	missing := NewStorage(path)
+	missing.UseKeyring(stale)
+	if problems := missing.IntegrityErrors(); len(problems) != 2 {
+		t.Errorf("Expected missing keys to be integrity errors, got %v", problems)
+	}
+
+	// A wrong master key must not lose the sealed facts.
+	wrong, _ := NewKeyring(bytes.Repeat([]byte{8}, 32), path+".keys")
+	locked := NewStorage(path)
+	locked.UseKeyring(wrong)
+	if problems := locked.IntegrityErrors(); len(problems) != 2 {
+		t.Errorf("Expected both sessions to fail decryption, got %v", problems)
+	}
+	if problems := NewStorage(path).IntegrityErrors(); len(problems) != 0 {
+		t.Errorf("Without UseKeyring nothing is checked yet, got %v", problems)
+	}
+	unkeyed := NewStorage(path)
+	unkeyed.UseKeyring(nil)
+	if problems := unkeyed.IntegrityErrors(); len(problems) != 2 {
+		t.Errorf("Expected sealed sessions to be reported without a key, got %v", problems)
+	}
+
+	// Erasing one user leaves the other readable and their old ciphertext useless.
+	snapshot, _ := os.ReadFile(path)
+	snapshotSum, _ := os.ReadFile(checksumPath(path))
+	erased := reloaded.GetSession(1)
+	erased.State, erased.CurrentKey = StateTypingReply, "age"
+	erased.Suspended = []Conversation{{State: StateTypingChoice}}
+	if err := reloaded.EraseFacts(1); err != nil {
+		t.Fatal(err)
+	}
+	if len(erased.UserData) != 0 || erased.CurrentKey != "" || erased.Suspended != nil || erased.State != StateChoosing {
+		t.Errorf("Erased facts and the categories they name should be cleared in memory, got %+v", erased)
+	}
+	after := open() // The file on disk still has user 1's old ciphertext.
+	if got := after.GetSession(1); len(got.UserData) != 0 || got.SealedData != "" {
+		t.Errorf("Erased user's facts should be unrecoverable, got %+v", got)
+	}
+	if got := after.GetSession(2); got.UserData["age"] != "40" {
+		t.Errorf("Other users should be unaffected, got %+v", got)
+	}
+
+	// New facts get a new key; a snapshot from before the erase still reads as erased.
+	erased.UserData["age"] = "35"
+	reloaded.Save()
+	os.WriteFile(path, snapshot, 0644)
+	os.WriteFile(checksumPath(path), snapshotSum, 0644)
+	restored := open()
+	if got, problems := restored.GetSession(1), restored.IntegrityErrors(); len(got.UserData) != 0 || len(problems) != 0 {
+		t.Errorf("Old ciphertext should stay erased after a new key, got %+v (%v)", got, problems)
+	}
+}
+
+func TestGreetings(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	recent := now.Add(-time.Hour).Unix()
+	longAgo := now.Add(-60 * 24 * time.Hour).Unix()
+
+	tests := []struct {
+		name    string
+		session UserSession
+		kind    GreetingKind
+		want    string
+	}{
+		{"brand new", UserSession{}, GreetingNew, "tell me something about yourself"},
+		{"returning", UserSession{UserData: map[string]string{"age": "30"}, LastUpdated: recent}, GreetingReturning, "You already told me your age."},
+		{"imported", UserSession{UserData: map[string]string{"age": "30"}, FirstSeen: recent}, GreetingNew, "tell me something about yourself"},
+		{"long absence", UserSession{UserData: map[string]string{"age": "30"}, LastUpdated: longAgo}, GreetingLongAbsence, "It has been 60 days since we last talked. I still remember your age."},
+		{"mid conversation", UserSession{State: StateTypingReply, CurrentKey: "age", LastUpdated: longAgo}, GreetingResume, "Back to where we were: your age?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := chooseGreeting(&tt.session, now); kind != tt.kind {
+				t.Fatalf("Expected %s greeting, got %s", tt.kind, kind)
+			}
+			if text := renderGreeting(tt.kind, "Ann", &tt.session, now); !strings.Contains(text, tt.want) || !strings.Contains(text, "Ann") {
+				t.Errorf("Unexpected greeting: %q", text)
+			}
+		})
+	}
+}
+
+func TestPendingSinceRestart(t *testing.T) {
+	before := processStarted.Add(-time.Minute).Unix()
+	after := processStarted.Add(time.Minute).Unix()
+
+	if !pendingSinceRestart(&UserSession{State: StateTypingReply, CurrentKey: "age", LastUpdated: before}) {
+		t.Error("A conversation persisted by the previous run should be reminded")
+	}
+	if pendingSinceRestart(&UserSession{State: StateTypingReply, LastUpdated: after}) {
+		t.Error("Users who already wrote to this process need no reminder")
+	}
+	if pendingSinceRestart(&UserSession{State: StateChoosing, LastUpdated: before}) {
+		t.Error("Idle users have nothing to resume")
+	}
+	if pendingSinceRestart(&UserSession{State: StateTypingReply, LastUpdated: before, Blocked: true}) {
+		t.Error("Users who blocked the bot must not be messaged")
+	}
+	if pendingSinceRestart(&UserSession{State: StateTypingReply, LastUpdated: processStarted.Add(-48 * time.Hour).Unix()}) {
+		t.Error("Long-abandoned conversations should not be reminded")
+	}
+
+	bot, sent := newFakeBot(t)
+	storage := &ThreadSafeStorage{Sessions: map[int64]*UserSession{
+		1: {State: StateTypingReply, CurrentKey: "age", UserData: map[string]string{}, LastUpdated: before},
+		2: {State: StateChoosing, UserData: map[string]string{}, LastUpdated: before},
+	}}
+	stopped := make(chan struct{})
+	close(stopped)
+	if remindAfterRestart(storage, bot, stopped) || len(sent()) != 0 {
+		t.Fatal("No reminders should be sent once shutdown has started")
+	}
+	if !remindAfterRestart(storage, bot, nil) {
+		t.Fatal("Expected a reminder to be sent")
+	}
+	if got := sent(); len(got) != 1 || !strings.Contains(got[0], "your age?") {
+		t.Errorf("Unexpected reminders: %q", got)
+	}
+	if remindAfterRestart(storage, bot, nil) || len(sent()) != 1 {
+		t.Error("A user should be reminded only once per interruption")
+	}
+}
+
+func TestInputHints(t *testing.T) {
+	if got := len(mainKeyboard.Keyboard); got != 3 {
+		t.Fatalf("Expected 3 keyboard rows, got %d", got)
+	}
+	if mainKeyboard.InputFieldPlaceholder == "" {
+		t.Error("Main keyboard should carry a placeholder")
+	}
+	if categoryByLabel("Age") == nil || categoryByLabel("age") != nil {
+		t.Error("Categories should match their exact button label only")
+	}
+	if got := valuePlaceholder("age"); got != "Type your age…" {
+		t.Errorf("Expected the Age category placeholder, got %q", got)
+	}
+	if got := valuePlaceholder("pet"); got != "Type your pet…" {
+		t.Errorf("Expected a generic placeholder for custom categories, got %q", got)
+	}
+	hint := inputHint(strings.Repeat("x", 100))
+	if !hint.ForceReply || !hint.Selective || utf8.RuneCountInString(hint.InputFieldPlaceholder) != 64 {
+		t.Errorf("Unexpected hint: %+v", hint)
+	}
+}
+
+func TestApplyBatch(t *testing.T) {
+	saved := quotas
+	defer func() { quotas = saved }()
+	quotas = Quotas{MaxValueRunes: 10}
+
+	session := &UserSession{UserData: map[string]string{}}
+	report, keys := applyBatch(session, "Age: 30\n\n  Favourite  Colour : Green \nno colon here\n: orphan\npet:\nbio: far too long for the quota", 7)
+
+	want := []string{
+		"✓ age: 30",
+		"✓ favourite colour: Green",
+		"✗ line 4: expected \"category: value\"",
+		"✗ line 5: the category is missing",
+		"✗ line 6: the value is missing",
+		"✗ line 7: That's a bit long",
+	}
+	if len(report) != len(want) {
+		t.Fatalf("Expected %d report lines, got %q", len(want), report)
+	}
+	for i := range want {
+		if !strings.HasPrefix(report[i], want[i]) {
+			t.Errorf("Line %d: expected %q, got %q", i, want[i], report[i])
+		}
+	}
+	if len(keys) != 2 || session.UserData["favourite colour"] != "Green" || session.FactUpdateIDs["age"] != 7 {
+		t.Errorf("Unexpected session after batch: %+v, saved %v", session, keys)
+	}
+	if _, ok := session.UserData["bio"]; ok {
+		t.Error("Rejected lines should not be stored")
+	}
+}
+
+func TestAggregateExport(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	storage := NewStorage(filepath.Join(t.TempDir(), "storage.json"))
+	storage.Sessions = map[int64]*UserSession{
+		1: {UserData: map[string]string{"age": "30", "secret hobby": "collecting spoons"}, LastUpdated: now.Add(-time.Hour).Unix()},
+		2: {UserData: map[string]string{"age": "41"}, LastUpdated: now.Add(-40 * 24 * time.Hour).Unix()},
+		3: {UserData: map[string]string{}},
+	}
+
+	agg := computeAggregates(storage.Sessions, now)
+	if agg.Sessions != 3 || agg.Categories["age"] != 2 || agg.Categories["other"] != 1 {
+		t.Errorf("Unexpected category counts: %+v", agg)
+	}
+	if _, leaked := agg.Categories["secret hobby"]; leaked {
+		t.Error("A category used by a single user must be folded into other")
+	}
+	if agg.FactLength["1-10"] != 2 || agg.FactLength["11-50"] != 1 {
+		t.Errorf("Unexpected length histogram: %v", agg.FactLength)
+	}
+	if agg.LastActive["<1d"] != 1 || agg.LastActive["30d+"] != 1 || agg.LastActive["never"] != 1 {
+		t.Errorf("Unexpected activity histogram: %v", agg.LastActive)
+	}
+
+	sink := filepath.Join(t.TempDir(), "aggregates.json")
+	if err := exportAggregates(computeAggregates(storage.Sessions, now), sink, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(sink)
+	for _, raw := range []string{`"30"`, `"41"`, "spoons", "secret"} {
+		if bytes.Contains(data, []byte(raw)) {
+			t.Errorf("Export leaked %q: %s", raw, data)
+		}
+	}
+}
+
+// newFakeBot returns a bot whose API calls go to a local server that accepts
+// everything, and a function listing the texts sent so far.
+func newFakeBot(t *testing.T) (*tgbotapi.BotAPI, func() []string) {
+	var mu sync.Mutex
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/getMe") {
+			w.Write([]byte(`{"ok": true, "result": {"id": 1, "is_bot": true, "username": "test_bot"}}`))
+			return
+		}
+		r.ParseForm()
+		mu.Lock()
+		sent = append(sent, r.FormValue("text"))
+		mu.Unlock()
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 1, "chat": {"id": 1}}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	bot, err := tgbotapi.NewBotAPIWithClient("token", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), sent...)
+	}
+}
+
+func TestTutorial(t *testing.T) {
+	bot, sent := newFakeBot(t)
+	guard = NewRateGuard()
+	session := &UserSession{State: StateChoosing, UserData: map[string]string{}}
+
+	ProcessUpdate(makeCommandUpdate("/start"), session, bot)
+	if !session.TutorialOffered || !strings.Contains(sent()[0], "/tutorial") {
+		t.Fatalf("New users should be offered the tutorial, got %q", sent())
+	}
+	ProcessUpdate(makeCommandUpdate("/start again"), session, bot) // Different text, or the double-tap guard drops it
+	if strings.Contains(sent()[1], "/tutorial") {
+		t.Error("The tutorial should only be offered once")
+	}
+
+	steps := []tgbotapi.Update{
+		makeCommandUpdate("/tutorial"),
+		makeMessageUpdate("Something else..."), // Not a category: step repeats
+		makeMessageUpdate("Age"),
+		makeMessageUpdate("30"),
+		makeMessageUpdate("hello"), // Needs /show_data
+		makeCommandUpdate("/show_data"),
+		makeMessageUpdate("Done"),
+	}
+	wantStep := []int{tutorialPickCategory, tutorialPickCategory, tutorialAnswer, tutorialShowData, tutorialShowData, tutorialFinish}
+	for i, update := range steps {
+		ProcessUpdate(update, session, bot)
+		if i < len(wantStep) && (session.State != StateTutorial || session.QuestionIndex != wantStep[i]) {
+			t.Fatalf("After %q: state %d step %d, want step %d", update.Message.Text, session.State, session.QuestionIndex, wantStep[i])
+		}
+	}
+	if session.State != StateChoosing || session.UserData["age"] != "30" {
+		t.Errorf("Tutorial should finish at the menu with the fact saved, got %+v", session)
+	}
+	if texts := sent(); !strings.Contains(texts[len(texts)-1], "whole tour") {
+		t.Errorf("Unexpected final message: %q", texts[len(texts)-1])
+	}
+}
+
+func TestLifecycleNotifications(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	proc := &lifecycle{PIDFile: filepath.Join(dir, "bot.pid"), ReadyFile: filepath.Join(dir, "ready")}
+	os.WriteFile(proc.PIDFile, []byte("1\n"), 0644)
+	proc.stopped()
+	if _, err := os.Stat(proc.PIDFile); err != nil {
+		t.Error("A process stopped before starting must not remove another instance's PID file")
+	}
+	proc.started()
+	proc.ready()
+	if pid, _ := os.ReadFile(proc.PIDFile); strings.TrimSpace(string(pid)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("Unexpected PID file contents %q", pid)
+	}
+	if _, err := os.Stat(proc.ReadyFile); err != nil {
+		t.Errorf("Ready file should exist while polling: %v", err)
+	}
+
+	proc.stopping()
+	if _, err := os.Stat(proc.ReadyFile); !os.IsNotExist(err) {
+		t.Error("Ready file should be removed as soon as shutdown starts")
+	}
+	proc.stopped()
+	if _, err := os.Stat(proc.PIDFile); !os.IsNotExist(err) {
+		t.Error("PID file should be removed on exit")
+	}
+
+	buf := make([]byte, 256)
+	for _, want := range []string{"READY=1", "STOPPING=1"} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil || !strings.HasPrefix(string(buf[:n]), want) {
+			t.Errorf("Expected %s notification, got %q (%v)", want, buf[:n], err)
+		}
+	}
+}
+
+func TestLogLevelFilter(t *testing.T) {
+	var buf bytes.Buffer
+	filter := &levelFilter{out: &buf}
+	filter.min.Store(LevelWarn)
+	logger := log.New(filter, "", log.LstdFlags)
+
+	logger.Println("[DEBUG] noisy")
+	logger.Println("[INFO] routine")
+	logger.Println("[UPDATE] counts as info")
+	logger.Println("[WARN] kept")
+	logger.Println("[ERROR] kept too")
+	filter.min.Store(LevelError)
+	logger.Println("Not starting: untagged [fatal] messages are always kept")
+	if got := buf.String(); strings.Contains(got, "noisy") || strings.Contains(got, "routine") || strings.Contains(got, "info") ||
+		!strings.Contains(got, "[WARN] kept") || !strings.Contains(got, "[ERROR] kept too") || !strings.Contains(got, "Not starting") {
+		t.Errorf("Unexpected filtered output:\n%s", got)
+	}
+
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("Unknown levels should be rejected")
+	}
+}
+
+func TestAdminRuntimeLogging(t *testing.T) {
+	bot, sent := newFakeBot(t)
+	defer func(id int64) { adminChatID = id }(adminChatID)
+	defer func(level int32) { logLevel.min.Store(level) }(logLevel.min.Load())
+	adminChatID = 1
+
+	handleAdmin(ptr(makeCommandUpdate("/admin loglevel ERROR")), nil, bot)
+	if logLevel.min.Load() != LevelError {
+		t.Errorf("Expected level error, got %d", logLevel.min.Load())
+	}
+	defer telegramDebug.Store(false)
+	handleAdmin(ptr(makeCommandUpdate("/admin debug on")), nil, bot)
+	if !telegramDebug.Load() || bot.Debug {
+		t.Error("Expected Telegram API debug logging to be on, without touching bot.Debug")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer server.Close()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(logLevel)
+	req, _ := http.NewRequest("POST", server.URL+"/botSECRET/sendMessage", strings.NewReader("chat_id=1&text=hi"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := debugClient{server.Client()}.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if got := buf.String(); string(body) != `{"ok": true}` || !strings.Contains(got, "sendMessage, params: chat_id=1&text=hi") ||
+		!strings.Contains(got, `response: {"ok": true}`) || strings.Contains(got, "SECRET") {
+		t.Errorf("Unexpected debug log (body %q):\n%s", body, got)
+	}
+	buf.Reset()
+	req, _ = http.NewRequest("POST", "http://127.0.0.1:0/botSECRET/getMe", nil)
+	if _, err := (debugClient{server.Client()}).Do(req); err == nil || strings.Contains(buf.String(), "SECRET") {
+		t.Errorf("Expected a failed call logged without the token, got %v:\n%s", err, buf.String())
+	}
+	handleAdmin(ptr(makeCommandUpdate("/admin debug maybe")), nil, bot)
+	if texts := sent(); !strings.HasPrefix(texts[len(texts)-1], "Usage: /admin debug") {
+		t.Errorf("Expected usage for a bad argument, got %q", texts)
+	}
+}
+
+func TestAdminReplyFailureHidesError(t *testing.T) {
+	bot, sent := newFakeBot(t)
+	defer func(id int64) { adminChatID = id }(adminChatID)
+	defer func(s *ThreadSafeStorage) { store = s }(store)
+	adminChatID = 1
+	store = NewStorage(filepath.Join(t.TempDir(), "sessions.json"))
+	store.GetOrCreateSession(42).Blocked = true
+
+	handleAdmin(ptr(makeCommandUpdate("/admin reply 42 hello")), nil, bot)
+	if texts := sent(); len(texts) != 1 || texts[0] != "Could not deliver the reply to 42 (blocked)." {
+		t.Errorf("Expected only the failure kind in the admin chat, got %q", texts)
+	}
+}
+
+func ptr(update tgbotapi.Update) *tgbotapi.Update { return &update }
+
+type recordingAnalytics struct{ events []AnalyticsEvent }
+
+func (r *recordingAnalytics) Track(event AnalyticsEvent) { r.events = append(r.events, event) }
+func (r *recordingAnalytics) Close()                     {}
+
+func TestObserveTransition(t *testing.T) {
+	key := "from=typing_reply,to=typing_reply,handler=test_reprompt,outcome=stayed"
+	before := mapCount(stateTransitions, key)
+	observeTransition("test_reprompt", StateTypingReply, StateTypingReply)
+
+	if got := mapCount(stateTransitions, key) - before; got != 1 {
+		t.Errorf("Expected one %s transition, got %d", key, got)
+	}
+}
+
+func TestAnalyticsLabels(t *testing.T) {
+	recorder := &recordingAnalytics{}
+	defer func(hook AnalyticsHook) { analytics = hook }(analytics)
+	analytics = recorder
+	bot, _ := newFakeBot(t)
+	guard = NewRateGuard()
+	session := &UserSession{State: StateChoosing, UserData: map[string]string{}}
+
+	for _, text := range []string{"Age", "30", customChoiceLabel, "my diagnosis", "private", "/show_data", "/whatever"} {
+		update := makeMessageUpdate(text)
+		if strings.HasPrefix(text, "/") {
+			update = makeCommandUpdate(text)
+		}
+		ProcessUpdate(update, session, bot)
+	}
+
+	var got []string
+	for _, event := range recorder.events {
+		switch event.Name {
+		case EventFactSaved:
+			got = append(got, event.Properties["category"])
+		case EventCommandUsed:
+			got = append(got, "/"+event.Properties["command"])
+		}
+	}
+	if joined := strings.Join(got, ","); joined != "age,custom,/show_data,/other" {
+		t.Errorf("Analytics labels = %s, want age,custom,/show_data,/other", joined)
+	}
+}
+
+func TestConversationEvents(t *testing.T) {
+	recorder := &recordingAnalytics{}
+	defer func(hook AnalyticsHook) { analytics = hook }(analytics)
+	analytics = recorder
+	bot, _ := newFakeBot(t)
+	guard = NewRateGuard()
+	session := &UserSession{State: StateChoosing, UserData: map[string]string{}}
+
+	for _, text := range []string{"Age", "30", "/batch", "/cancel", "Done"} {
+		update := makeMessageUpdate(text)
+		if strings.HasPrefix(text, "/") {
+			update = makeCommandUpdate(text)
+		}
+		ProcessUpdate(update, session, bot)
+	}
+
+	var got []string
+	for _, event := range recorder.events {
+		if event.Name == EventConversation {
+			got = append(got, event.Properties["flow"]+":"+event.Properties["result"])
+		}
+	}
+	// The batch interrupts the main conversation, which is resumed and then finished.
+	if joined := strings.Join(got, ","); joined != "batch:cancelled,main:completed" {
+		t.Errorf("Conversation events = %s, want batch:cancelled,main:completed", joined)
+	}
+	if session.ConversationFlow != "" || session.ConversationStarted != 0 || len(session.Suspended) != 0 {
+		t.Errorf("Finished conversation left state behind: %+v", session)
+	}
+
+	// Cancelling at the main menu, with nothing running, is not a conversation.
+	recorder.events = nil
+	ProcessUpdate(makeCommandUpdate("/cancel"), session, bot)
+	for _, event := range recorder.events {
+		if event.Name == EventConversation {
+			t.Errorf("Idle /cancel emitted %+v", event)
+		}
+	}
+}
+
+func TestNormalizeValue(t *testing.T) {
+	defer func(pipeline []string, lower map[string]bool) {
+		valuePipeline, lowercaseCategories = pipeline, lower
+	}(valuePipeline, lowercaseCategories)
+
+	if got := normalizeValue("name", "  Anna   Maria\tSmith "); got != "Anna Maria Smith" {
+		t.Errorf("Default pipeline should keep case, got %q", got)
+	}
+
+	t.Setenv("VALUE_NORMALIZE", "trim")
+	t.Setenv("VALUE_LOWERCASE", "Favourite Colour")
+	lowercaseCategories = map[string]bool{}
+	if err := loadValueNormalizationFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if got := normalizeValue("favourite colour", " Dark  Blue "); got != "dark  blue" {
+		t.Errorf("Listed category should be lowercased, got %q", got)
+	}
+	if got := normalizeValue("code", " AB-12 "); got != "AB-12" {
+		t.Errorf("Other categories should keep case, got %q", got)
+	}
+
+	// Existing data is renormalised on load.
+	session := &UserSession{UserData: map[string]string{"Favourite colour": "  GREEN ", "code": " XY "}}
+	normalizeSessionFacts(session)
+	if session.UserData["favourite colour"] != "green" || session.UserData["code"] != "XY" {
+		t.Errorf("Unexpected migrated facts: %v", session.UserData)
+	}
+
+	t.Setenv("VALUE_NORMALIZE", "trim,shout")
+	if err := loadValueNormalizationFromEnv(); err == nil {
+		t.Error("Unknown steps should be rejected")
+	}
+}
+
+func TestSavePolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	storage := NewStorage(path)
+	storage.GetOrCreateSession(1).UserData["age"] = "30"
+
+	if _, err := NewSavePolicy("sometimes", time.Second); err == nil {
+		t.Error("Unknown strategies should be rejected")
+	}
+
+	every, _ := NewSavePolicy(SaveEveryUpdate, 0)
+	if every.Due() != nil {
+		t.Error("every-update should never schedule a deferred save")
+	}
+	every.Changed(storage)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("every-update should save immediately: %v", err)
+	}
+
+	os.Remove(path)
+	debounce, _ := NewSavePolicy(SaveDebounce, 20*time.Millisecond)
+	debounce.Changed(storage)
+	debounce.Changed(storage)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("debounce should not save until the quiet period passes")
+	}
+	if storageUnsaved.Value() != 2 {
+		t.Errorf("Expected 2 unsaved updates, got %d", storageUnsaved.Value())
+	}
+	select {
+	case <-debounce.Due():
+		debounce.Tick(storage)
+	case <-time.After(time.Second):
+		t.Fatal("debounce timer never fired")
+	}
+	if _, err := os.Stat(path); err != nil || storageUnsaved.Value() != 0 {
+		t.Errorf("Expected a save after the quiet period (unsaved %d): %v", storageUnsaved.Value(), err)
+	}
+
+	// A steady stream of updates cannot put the save off beyond debounceMaxWait intervals.
+	os.Remove(path)
+	capped, _ := NewSavePolicy(SaveDebounce, 5*time.Millisecond)
+	deadline := time.After(time.Second)
+	for saved := false; !saved; {
+		capped.Changed(storage)
+		select {
+		case <-capped.Due():
+			capped.Tick(storage)
+			saved = true
+		case <-time.After(time.Millisecond):
+		case <-deadline:
+			t.Fatal("debounce never saved under constant updates")
+		}
+	}
+
+	os.Remove(path)
+	interval, _ := NewSavePolicy(SaveInterval, time.Hour)
+	interval.Tick(storage)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("interval should skip the save when nothing changed")
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	defer func() {
+		faults.StorageWrite, faults.Send, faults.Handler = nil, nil, nil
+	}()
+
+	t.Run("storage write failure", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "storage.json")
+		storage := NewStorage(path)
+		storage.GetOrCreateSession(1).UserData["age"] = "30"
+		faults.StorageWrite = func(string) error { return errors.New("disk full") }
+
+		policy, _ := NewSavePolicy(SaveInterval, time.Hour)
+		policy.Changed(storage)
+		policy.Tick(storage)
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatal("A failed write should leave no file behind")
+		}
+		if storageUnsaved.Value() != 1 {
+			t.Errorf("Failed save should stay pending, unsaved = %d", storageUnsaved.Value())
+		}
+
+		faults.StorageWrite = nil
+		policy.Tick(storage)
+		if reloaded := NewStorage(path); reloaded.GetSession(1) == nil {
+			t.Error("The retried save should reach disk")
+		}
+	})
+
+	t.Run("telegram 429 then success", func(t *testing.T) {
+		bot, sent := newFakeBot(t)
+		calls := 0
+		faults.Send = func(tgbotapi.Chattable) error {
+			if calls++; calls == 1 {
+				return &tgbotapi.Error{Code: http.StatusTooManyRequests, Message: "Too Many Requests", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 1}}
+			}
+			return nil
+		}
+		before := expvarCount(sendErrors, SendTransient.String())
+		session := &UserSession{}
+		if err := sendPaced(bot, session, tgbotapi.NewMessage(1, "hello")); err != nil {
+			t.Fatalf("sendPaced should wait out the 429 and succeed: %v", err)
+		}
+		if len(sent()) != 1 || expvarCount(sendErrors, SendTransient.String()) == before {
+			t.Errorf("Expected one delivered message after a counted transient error, sent %q", sent())
+		}
+	})
+
+	t.Run("telegram 500 is transient", func(t *testing.T) {
+		bot, sent := newFakeBot(t)
+		faults.Send = func(tgbotapi.Chattable) error { return &tgbotapi.Error{Code: 500, Message: "Internal Server Error"} }
+		session := &UserSession{}
+		var sendErr *SendError
+		if err := send(bot, session, tgbotapi.NewMessage(1, "hello")); !errors.As(err, &sendErr) || sendErr.Kind != SendTransient {
+			t.Errorf("Expected a transient send error, got %v", err)
+		}
+		if len(sent()) != 0 || session.Blocked {
+			t.Error("An injected failure should not reach Telegram or block the user")
+		}
+	})
+
+	t.Run("slow handler", func(t *testing.T) {
+		defer func(budget time.Duration) { handlerBudget = budget }(handlerBudget)
+		handlerBudget = time.Millisecond
+		faults.Handler = func(string) { time.Sleep(5 * time.Millisecond) }
+
+		update := makeMessageUpdate("x")
+		before := mapCount(handlerSlow, "fault_slow")
+		runHandler("fault_slow", func(*tgbotapi.Update, *UserSession, *tgbotapi.BotAPI) {}, &update, &UserSession{}, nil)
+		if got := mapCount(handlerSlow, "fault_slow") - before; got != 1 {
+			t.Errorf("Expected the injected delay to count as slow, got %d", got)
+		}
+	})
+}